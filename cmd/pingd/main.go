@@ -2,17 +2,26 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/ericyan/iputil"
 	"github.com/ericyan/pingd/pkg/ping"
+	"github.com/google/gopacket/layers"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -21,8 +30,38 @@ var (
 	bind     = flag.String("bind", "", "interface to bind")
 	port     = flag.Int("port", 9344, "port to listen on for HTTP requests")
 	icmp     = flag.Bool("icmp", true, "use ICMP ping")
+	icmpTS   = flag.Bool("icmp-timestamp", false, "use ICMP timestamp requests instead of echo requests")
 	tcp      = flag.Bool("tcp", false, "use TCP ping")
+	tcpReset = flag.Bool("tcp-reset", true, "send RST after SYN-ACK in TCP ping")
+	udp      = flag.Bool("udp", false, "use UDP ping")
+	udpEcho  = flag.Bool("udp-echo", false, "expect UDP replies from an echo service instead of ICMP port unreachable errors")
+	stamp    = flag.Bool("stamp", false, "use STAMP (RFC 8762) ping against session-reflectors")
+	reflect  = flag.String("reflector", "", "address to answer STAMP test packets on, such as :862")
+	httpPing = flag.Bool("http", false, "use HTTP ping against the URLs in the destination list")
+	method   = flag.String("http-method", "GET", "method of HTTP ping requests, GET or HEAD")
+	dnsPing  = flag.Bool("dns", false, "use DNS ping against the resolvers in the destination list")
+	dnsName  = flag.String("dns-name", "example.com", "name to query in DNS ping")
+	dnsType  = flag.String("dns-type", "A", "type of the query in DNS ping, such as A or AAAA")
+	dnsTCP   = flag.Bool("dns-tcp", false, "send DNS queries over TCP")
+	tlsPing  = flag.Bool("tls", false, "use TLS handshake ping")
+	insecure = flag.Bool("tls-insecure", false, "skip verifying certificates in HTTP and TLS ping")
+	socket   = flag.String("socket", "auto", "socket type: auto, raw or dgram, the latter for ICMP ping only")
+	timeout  = flag.Duration("timeout", 5*time.Second, "time to wait for a reply")
+	size     = flag.Int("size", 56, "payload size in bytes of ICMP, UDP and STAMP probes")
+	pattern  = flag.String("pattern", "", "hex-encoded bytes to fill the ICMP and UDP payload with")
+	ttl      = flag.Int("ttl", 0, "TTL or hop limit of outgoing packets")
+	tos      = flag.Int("tos", 0, "TOS or traffic class of outgoing packets, DSCP is the upper 6 bits")
+	df       = flag.Bool("df", false, "set the don't fragment bit")
+	src      = flag.String("src", "", "source address of outgoing packets")
+	iface    = flag.String("iface", "", "network interface to send packets from")
+	hwstamp  = flag.Bool("hwstamp", false, "use hardware receive timestamps if the interface supports them")
 	interval = flag.Int("interval", 3, "seconds to wait between sending each packet")
+	traceInt = flag.Int("trace-interval", 0, "seconds to wait between traceroutes to each destination, 0 to disable")
+	maxHops  = flag.Int("max-hops", 30, "maximum number of hops probed by traceroutes")
+	flows    = flag.Int("trace-flows", 16, "maximum number of flows traced to enumerate equal-cost paths, 1 to trace a single path")
+	pmtuInt  = flag.Int("pmtu-interval", 0, "seconds to wait between path MTU discoveries for each destination, 0 to disable")
+	pmtuMin  = flag.Int("pmtu-min", 1280, "smallest path MTU expected, in bytes including the IP header")
+	pmtuMax  = flag.Int("pmtu-max", 1500, "largest path MTU probed, in bytes including the IP header")
 	dstList  = flag.String("list", "./dst.list", "path to destination list")
 	verbose  = flag.Bool("v", false, "enable verbose logging")
 )
@@ -43,11 +82,450 @@ var (
 		},
 		[]string{"src", "dst"},
 	)
+	totalFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ping_failures_total",
+			Help: "Total number of failed ping requests by reason.",
+		},
+		[]string{"src", "dst", "reason"},
+	)
+	replyTTL = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ping_reply_ttl",
+			Help: "TTL or hop limit of the last reply.",
+		},
+		[]string{"src", "dst"},
+	)
+	totalImplausible = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ping_implausible_rtt_total",
+			Help: "Total number of RTT samples discarded for being negative or exceeding the timeout.",
+		},
+		[]string{"src", "dst"},
+	)
+	owdForward = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ping_owd_forward_seconds",
+			Help:    "One-way delay from the source to the STAMP reflector or ICMP timestamp responder in seconds, only observed if both clocks are synchronized.",
+			Buckets: []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.2, 0.3, 0.5, 1},
+		},
+		[]string{"src", "dst"},
+	)
+	owdReverse = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ping_owd_reverse_seconds",
+			Help:    "One-way delay from the STAMP reflector or ICMP timestamp responder to the source in seconds, only observed if both clocks are synchronized.",
+			Buckets: []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.2, 0.3, 0.5, 1},
+		},
+		[]string{"src", "dst"},
+	)
+	jitterForward = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ping_jitter_forward_seconds",
+			Help: "Interarrival jitter from the source to the STAMP reflector or ICMP timestamp responder in seconds, as defined in RFC 3550.",
+		},
+		[]string{"src", "dst"},
+	)
+	jitterReverse = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ping_jitter_reverse_seconds",
+			Help: "Interarrival jitter from the STAMP reflector or ICMP timestamp responder to the source in seconds, as defined in RFC 3550.",
+		},
+		[]string{"src", "dst"},
+	)
+	clockOffset = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ping_clock_offset_seconds",
+			Help: "Estimated offset of the clock of the STAMP reflector or ICMP timestamp responder relative to the local one in seconds.",
+		},
+		[]string{"src", "dst"},
+	)
+	clockSynchronized = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ping_clock_synchronized",
+			Help: "Whether both the local clock and the one of the STAMP reflector or ICMP timestamp responder are believed to be synchronized.",
+		},
+		[]string{"src", "dst"},
+	)
+	httpDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ping_http_duration_seconds",
+			Help:    "Time taken by phases of HTTP ping requests in seconds.",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		},
+		[]string{"src", "dst", "phase"},
+	)
+	tlsDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ping_tls_duration_seconds",
+			Help:    "Time taken by phases of TLS ping handshakes in seconds.",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		},
+		[]string{"src", "dst", "phase"},
+	)
+	tlsCertExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ping_tls_cert_expiry_timestamp_seconds",
+			Help: "Expiry of the certificate presented in TLS ping handshakes, in seconds since the Unix epoch.",
+		},
+		[]string{"src", "dst"},
+	)
+	tlsInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ping_tls_info",
+			Help: "TLS version and cipher suite negotiated in the last TLS ping handshake, always 1.",
+		},
+		[]string{"src", "dst", "version", "cipher"},
+	)
+	hopRTT = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ping_hop_rtt_seconds",
+			Help:    "Round-trip time to the hops towards the destination in seconds, as measured by traceroutes.",
+			Buckets: []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.2, 0.3, 0.5, 1},
+		},
+		[]string{"src", "dst", "flow", "hop", "hop_addr"},
+	)
+	hopMPLS = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ping_hop_mpls_info",
+			Help: "MPLS label stack the traceroute probes arrived with at the hops towards the destination, always 1.",
+		},
+		[]string{"src", "dst", "flow", "hop", "hop_addr", "mpls_labels"},
+	)
+	hopRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ping_hop_requests_total",
+			Help: "Total number of traceroute probes sent to the hops towards the destination.",
+		},
+		[]string{"src", "dst", "flow", "hop"},
+	)
+	hopLost = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ping_hop_lost_total",
+			Help: "Total number of traceroute probes to the hops towards the destination which were not answered.",
+		},
+		[]string{"src", "dst", "flow", "hop"},
+	)
+	pathMTU = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ping_path_mtu_bytes",
+			Help: "Path MTU to the destination in bytes, as found by the last discovery.",
+		},
+		[]string{"src", "dst"},
+	)
+	pathMTUBlackHole = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ping_path_mtu_black_hole",
+			Help: "Whether packets larger than the path MTU were lost without ICMP packet too big errors in the last discovery.",
+		},
+		[]string{"src", "dst"},
+	)
+	totalDuplicates = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ping_duplicates_total",
+			Help: "Total number of ping requests which received duplicate replies.",
+		},
+		[]string{"src", "dst"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(rttHistogram)
 	prometheus.MustRegister(totalRequests)
+	prometheus.MustRegister(totalFailures)
+	prometheus.MustRegister(replyTTL)
+	prometheus.MustRegister(totalDuplicates)
+	prometheus.MustRegister(totalImplausible)
+	prometheus.MustRegister(owdForward)
+	prometheus.MustRegister(owdReverse)
+	prometheus.MustRegister(jitterForward)
+	prometheus.MustRegister(jitterReverse)
+	prometheus.MustRegister(clockOffset)
+	prometheus.MustRegister(clockSynchronized)
+	prometheus.MustRegister(httpDuration)
+	prometheus.MustRegister(tlsDuration)
+	prometheus.MustRegister(tlsCertExpiry)
+	prometheus.MustRegister(tlsInfo)
+	prometheus.MustRegister(hopRTT)
+	prometheus.MustRegister(hopMPLS)
+	prometheus.MustRegister(hopRequests)
+	prometheus.MustRegister(hopLost)
+	prometheus.MustRegister(pathMTU)
+	prometheus.MustRegister(pathMTUBlackHole)
+}
+
+// reason returns the label value used to count a failed ping.
+func reason(err error) string {
+	var icmpErr *ping.ICMPError
+	var statusErr *ping.HTTPStatusError
+	var rcodeErr *ping.RcodeError
+	var handshakeErr *ping.TLSHandshakeError
+	switch {
+	case errors.As(err, &rcodeErr):
+		return rcodeErr.Reason()
+	case errors.As(err, &icmpErr):
+		return icmpErr.Reason()
+	case errors.As(err, &statusErr):
+		return fmt.Sprintf("http_%dxx", statusErr.StatusCode/100)
+	case errors.As(err, &handshakeErr):
+		return "tls_handshake"
+	case errors.Is(err, ping.ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ping.ErrPortClosed):
+		return "port_closed"
+	default:
+		return "other"
+	}
+}
+
+var (
+	tlsVersions = map[uint16]string{
+		tls.VersionTLS10: "1.0",
+		tls.VersionTLS11: "1.1",
+		tls.VersionTLS12: "1.2",
+		tls.VersionTLS13: "1.3",
+	}
+	tlsCipherSuites = map[uint16]string{
+		tls.TLS_RSA_WITH_RC4_128_SHA:                "TLS_RSA_WITH_RC4_128_SHA",
+		tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:           "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "TLS_RSA_WITH_AES_128_CBC_SHA",
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "TLS_RSA_WITH_AES_256_CBC_SHA",
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         "TLS_RSA_WITH_AES_128_CBC_SHA256",
+		tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         "TLS_RSA_WITH_AES_128_GCM_SHA256",
+		tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         "TLS_RSA_WITH_AES_256_GCM_SHA384",
+		tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+		tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:          "TLS_ECDHE_RSA_WITH_RC4_128_SHA",
+		tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:     "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:    "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+		tls.TLS_AES_128_GCM_SHA256:                  "TLS_AES_128_GCM_SHA256",
+		tls.TLS_AES_256_GCM_SHA384:                  "TLS_AES_256_GCM_SHA384",
+		tls.TLS_CHACHA20_POLY1305_SHA256:            "TLS_CHACHA20_POLY1305_SHA256",
+	}
+)
+
+// tlsVersionName returns the label value of a TLS version.
+func tlsVersionName(v uint16) string {
+	if name, ok := tlsVersions[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// tlsCipherSuiteName returns the label value of a TLS cipher suite. The
+// crypto/tls package of Go 1.13 cannot name them itself.
+func tlsCipherSuiteName(id uint16) string {
+	if name, ok := tlsCipherSuites[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", id)
+}
+
+// hostAddr returns the IP address of the host addr refers to, or nil if
+// it does not refer to a single one.
+func hostAddr(addr net.Addr) *net.IPAddr {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a
+	case *net.TCPAddr:
+		return &net.IPAddr{IP: a.IP, Zone: a.Zone}
+	case *net.UDPAddr:
+		return &net.IPAddr{IP: a.IP, Zone: a.Zone}
+	case *ping.TLSAddr:
+		return &net.IPAddr{IP: a.IP, Zone: a.Zone}
+	default:
+		return nil
+	}
+}
+
+// trace runs traceroutes to addr every trace interval until ctx is done.
+// Each of the distinct paths found is recorded with the flow which took
+// it.
+func trace(ctx context.Context, tracer *ping.Tracer, dst string, addr *net.IPAddr) {
+	ticker := time.NewTicker(time.Duration(*traceInt) * time.Second)
+	defer ticker.Stop()
+
+	// Labels of the MPLS info of each flow and hop, so that the series
+	// can be removed once the hop answers with another label stack.
+	mpls := make(map[string]prometheus.Labels)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		paths, err := tracer.Paths(ctx, addr)
+		if err == context.Canceled || err == ping.ErrClosed {
+			return
+		}
+		if err != nil {
+			if *verbose {
+				log.Printf("dst=%s trace err=%s", dst, err)
+			}
+			continue
+		}
+
+		for _, path := range paths {
+			for _, hop := range path.Hops {
+				labels := prometheus.Labels{"src": *bind, "dst": dst, "flow": strconv.Itoa(path.Flow), "hop": strconv.Itoa(hop.TTL)}
+				hopRequests.With(labels).Inc()
+				if hop.Result == nil {
+					hopLost.With(labels).Inc()
+					continue
+				}
+				if errors.Is(hop.Err, ping.ErrImplausibleRTT) {
+					continue
+				}
+
+				labels["hop_addr"] = hostAddr(hop.Addr()).IP.String()
+				hopRTT.With(labels).Observe(hop.Result.RTT.Seconds())
+
+				// The label stack tells the LSP the probe
+				// traversed, from the top of the stack.
+				var stack []string
+				for _, l := range hop.MPLSLabels {
+					stack = append(stack, strconv.Itoa(l.Label))
+				}
+
+				key := labels["flow"] + "/" + labels["hop"]
+				info := prometheus.Labels{"mpls_labels": strings.Join(stack, ",")}
+				for k, v := range labels {
+					info[k] = v
+				}
+				if prev, ok := mpls[key]; ok {
+					hopMPLS.Delete(prev)
+					delete(mpls, key)
+				}
+				if len(stack) > 0 {
+					hopMPLS.With(info).Set(1)
+					mpls[key] = info
+				}
+			}
+		}
+	}
+}
+
+// discoverMTU runs path MTU discoveries to addr every path MTU interval
+// until ctx is done.
+func discoverMTU(ctx context.Context, prober *ping.MTUProber, dst string, addr *net.IPAddr) {
+	ticker := time.NewTicker(time.Duration(*pmtuInt) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		result, err := prober.Discover(ctx, addr)
+		if err == context.Canceled || err == ping.ErrClosed {
+			return
+		}
+		if err != nil {
+			if *verbose {
+				log.Printf("dst=%s pmtu err=%s", dst, err)
+			}
+			continue
+		}
+
+		labels := prometheus.Labels{"src": *bind, "dst": dst}
+		pathMTU.With(labels).Set(float64(result.MTU))
+		if result.BlackHole {
+			pathMTUBlackHole.With(labels).Set(1)
+		} else {
+			pathMTUBlackHole.With(labels).Set(0)
+		}
+	}
+}
+
+// A jitter estimates the interarrival jitter of packets sent in one
+// direction, as defined in RFC 3550 section 6.4.1.
+type jitter struct {
+	transit time.Duration
+	seen    bool
+	value   float64
+}
+
+// update adds a packet with the given transit time, i.e. one-way delay
+// plus clock offset, and returns the jitter in seconds.
+func (j *jitter) update(transit time.Duration) float64 {
+	if j.seen {
+		d := transit - j.transit
+		if d < 0 {
+			d = -d
+		}
+		j.value += (d.Seconds() - j.value) / 16
+	}
+	j.transit, j.seen = transit, true
+
+	return j.value
+}
+
+// parseDNSType returns the DNS type with the given name.
+func parseDNSType(name string) (layers.DNSType, error) {
+	for t := layers.DNSType(1); t < 256; t++ {
+		if strings.EqualFold(t.String(), name) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown DNS type: %s", name)
+}
+
+// newPinger returns the Pinger selected by the flags.
+func newPinger(opts []ping.Option) (ping.Pinger, error) {
+	switch {
+	case *tcp:
+		opts = append(opts, ping.WithReset(*tcpReset))
+		pinger, err := ping.NewTCP(opts...)
+		if err != nil && *socket == "auto" {
+			log.Printf("Raw sockets unavailable, using TCP connect: %s", err)
+			return ping.NewTCPConnect(opts...)
+		}
+		return pinger, err
+	case *udp:
+		return ping.NewUDP(append(opts, ping.WithEcho(*udpEcho))...)
+	case *stamp:
+		return ping.NewSTAMP(opts...)
+	case *httpPing:
+		return ping.NewHTTP(append(opts, ping.WithMethod(*method))...)
+	case *dnsPing:
+		qtype, err := parseDNSType(*dnsType)
+		if err != nil {
+			return nil, err
+		}
+		return ping.NewDNS(append(opts, ping.WithQuery(*dnsName, qtype))...)
+	case *tlsPing:
+		return ping.NewTLS(opts...)
+	case *icmpTS:
+		return ping.NewICMPTimestamp(opts...)
+	default:
+		var socketType ping.SocketType
+		switch *socket {
+		case "auto":
+			socketType = ping.SocketAuto
+		case "raw":
+			socketType = ping.SocketRaw
+		case "dgram":
+			socketType = ping.SocketDatagram
+		default:
+			return nil, fmt.Errorf("unknown socket type: %s", *socket)
+		}
+
+		return ping.NewICMP(append(opts, ping.WithSocketType(socketType))...)
+	}
 }
 
 func main() {
@@ -55,6 +533,9 @@ func main() {
 
 	if *bind == "" {
 		addr, err := iputil.DefaultIPv4()
+		if err != nil {
+			addr, err = iputil.DefaultIPv6()
+		}
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -62,57 +543,271 @@ func main() {
 		*bind = addr.IP.String()
 	}
 
+	modes := 0
+	for _, m := range []bool{*tcp, *udp, *stamp, *httpPing, *dnsPing, *tlsPing, *icmpTS} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 {
+		log.Fatalln("Only one of -tcp, -udp, -stamp, -http, -dns, -tls and -icmp-timestamp may be set")
+	}
+
+	// A reflector does not need any destinations to probe.
+	dsts := make(map[string]net.Addr)
 	f, err := os.Open(*dstList)
-	defer f.Close()
-	if err != nil {
+	if err != nil && !(os.IsNotExist(err) && *reflect != "") {
 		log.Fatalln(err)
 	}
+	if err == nil {
+		defer f.Close()
 
-	dsts := make(map[string]net.Addr)
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		dst := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			dst := strings.ToLower(strings.TrimSpace(scanner.Text()))
 
-		var addr net.Addr
-		if *tcp {
-			addr, err = net.ResolveTCPAddr("tcp4", dst)
-		} else {
-			addr, err = net.ResolveIPAddr("ip4", dst)
+			var addr net.Addr
+			switch {
+			case *httpPing:
+				// Paths of URLs are case-sensitive.
+				dst = strings.TrimSpace(scanner.Text())
+				addr, err = ping.ParseURL(dst)
+			case *tcp:
+				addr, err = net.ResolveTCPAddr("tcp", dst)
+			case *udp:
+				addr, err = net.ResolveUDPAddr("udp", dst)
+			case *stamp:
+				hostport := dst
+				if _, _, err := net.SplitHostPort(dst); err != nil {
+					hostport = net.JoinHostPort(dst, strconv.Itoa(ping.STAMPPort))
+				}
+				addr, err = net.ResolveUDPAddr("udp", hostport)
+			case *dnsPing:
+				hostport := dst
+				if _, _, err := net.SplitHostPort(dst); err != nil {
+					hostport = net.JoinHostPort(dst, "53")
+				}
+				if *dnsTCP {
+					addr, err = net.ResolveTCPAddr("tcp", hostport)
+				} else {
+					addr, err = net.ResolveUDPAddr("udp", hostport)
+				}
+			case *tlsPing:
+				hostport := dst
+				if _, _, err := net.SplitHostPort(dst); err != nil {
+					hostport = net.JoinHostPort(dst, "443")
+				}
+				addr, err = ping.ResolveTLSAddr(hostport)
+			default:
+				addr, err = net.ResolveIPAddr("ip", dst)
+			}
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if addr.String() != dst {
+				log.Printf("Destination %s resolved to %s", dst, addr.String())
+			}
+			dsts[dst] = addr
 		}
+
+		if err := scanner.Err(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	opts := []ping.Option{
+		ping.WithTimeout(*timeout),
+		ping.WithPayloadSize(*size),
+		ping.WithTTL(*ttl),
+		ping.WithTOS(*tos),
+		ping.WithDontFragment(*df),
+		ping.WithInterface(*iface),
+		ping.WithHardwareTimestamps(*hwstamp),
+	}
+	if *pattern != "" {
+		b, err := hex.DecodeString(*pattern)
 		if err != nil {
+			log.Fatalf("Invalid pattern: %s", err)
+		}
+		opts = append(opts, ping.WithPattern(b))
+	}
+	if *src != "" {
+		ip := net.ParseIP(*src)
+		if ip == nil {
+			log.Fatalf("Invalid source address: %s", *src)
+		}
+		opts = append(opts, ping.WithSource(ip))
+	}
+	if *insecure {
+		opts = append(opts, ping.WithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	}
+
+	// A reflector without destinations does not probe anything, so it
+	// does not need the privileges some pingers require either.
+	var pinger ping.Pinger
+	if len(dsts) > 0 || *reflect == "" {
+		if pinger, err = newPinger(opts); err != nil {
 			log.Fatalln(err)
 		}
-		if addr.String() != dst {
-			log.Printf("Destination %s resolved to %s", dst, addr.String())
+	}
+
+	var reflector *ping.Reflector
+	if *reflect != "" {
+		reflector, err = ping.NewReflector(*reflect, opts...)
+		if err != nil {
+			log.Fatalln(err)
 		}
-		dsts[dst] = addr
+		go func() {
+			log.Printf("Reflecting STAMP test packets at %s", reflector.Addr())
+			if err := reflector.Serve(); err != nil {
+				log.Fatal(err)
+			}
+		}()
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatalln(err)
+	var tracer *ping.Tracer
+	if *traceInt > 0 {
+		tracer, err = ping.NewTracer(append(opts, ping.WithMaxHops(*maxHops), ping.WithMaxFlows(*flows))...)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
 
-	var pinger ping.Pinger
-	if *tcp {
-		pinger, err = ping.NewTCP()
-	} else {
-		pinger, err = ping.NewICMP()
+	var prober *ping.MTUProber
+	if *pmtuInt > 0 {
+		prober, err = ping.NewMTUProber(append(opts, ping.WithMTURange(*pmtuMin, *pmtuMax))...)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
-	if err != nil {
-		log.Fatalln(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if prober != nil {
+		for dst, addr := range dsts {
+			ipAddr := hostAddr(addr)
+			if ipAddr == nil {
+				log.Printf("Not discovering the path MTU to %s", dst)
+				continue
+			}
+
+			wg.Add(1)
+			go func(dst string, addr *net.IPAddr) {
+				defer wg.Done()
+				discoverMTU(ctx, prober, dst, addr)
+			}(dst, ipAddr)
+		}
 	}
-	defer pinger.Close()
+	if tracer != nil {
+		for dst, addr := range dsts {
+			ipAddr := hostAddr(addr)
+			if ipAddr == nil {
+				log.Printf("Not tracing the route to %s", dst)
+				continue
+			}
 
+			wg.Add(1)
+			go func(dst string, addr *net.IPAddr) {
+				defer wg.Done()
+				trace(ctx, tracer, dst, addr)
+			}(dst, ipAddr)
+		}
+	}
 	for dst, addr := range dsts {
+		wg.Add(1)
 		go func(dst string, addr net.Addr) {
-			for range time.Tick(time.Duration(*interval) * time.Second) {
-				rtt, err := pinger.Ping(addr)
+			defer wg.Done()
+
+			ticker := time.NewTicker(time.Duration(*interval) * time.Second)
+			defer ticker.Stop()
+
+			var forwardJitter, reverseJitter jitter
+
+			// Labels of the TLS info of the last handshake, so that
+			// the series can be removed once the session changes.
+			var lastTLS prometheus.Labels
+
+			for {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+
+				result, err := pinger.Probe(ctx, addr)
+				if err == context.Canceled || err == ping.ErrClosed {
+					return
+				}
 				if err == nil {
-					rttHistogram.With(prometheus.Labels{"src": *bind, "dst": dst}).Observe(float64(rtt) / float64(time.Second))
+					rttHistogram.With(prometheus.Labels{"src": *bind, "dst": dst}).Observe(result.RTT.Seconds())
+
+					if result.TTL >= 0 {
+						replyTTL.With(prometheus.Labels{"src": *bind, "dst": dst}).Set(float64(result.TTL))
+					}
+					if result.Duplicate {
+						totalDuplicates.With(prometheus.Labels{"src": *bind, "dst": dst}).Inc()
+					}
+
+					if t := result.HTTP; t != nil {
+						for phase, d := range map[string]time.Duration{
+							"dns":        t.DNS,
+							"connect":    t.Connect,
+							"tls":        t.TLSHandshake,
+							"first_byte": t.FirstByte,
+							"total":      t.Total,
+						} {
+							// Skip phases which did not take place.
+							if d > 0 {
+								httpDuration.With(prometheus.Labels{"src": *bind, "dst": dst, "phase": phase}).Observe(d.Seconds())
+							}
+						}
+					}
+
+					if t := result.TLS; t != nil {
+						tlsDuration.With(prometheus.Labels{"src": *bind, "dst": dst, "phase": "connect"}).Observe(t.Connect.Seconds())
+						tlsDuration.With(prometheus.Labels{"src": *bind, "dst": dst, "phase": "handshake"}).Observe(t.Handshake.Seconds())
+						if !t.NotAfter.IsZero() {
+							tlsCertExpiry.With(prometheus.Labels{"src": *bind, "dst": dst}).Set(float64(t.NotAfter.Unix()))
+						}
+
+						labels := prometheus.Labels{"src": *bind, "dst": dst, "version": tlsVersionName(t.Version), "cipher": tlsCipherSuiteName(t.CipherSuite)}
+						if lastTLS != nil {
+							tlsInfo.Delete(lastTLS)
+						}
+						tlsInfo.With(labels).Set(1)
+						lastTLS = labels
+					}
+
+					if forward, reverse, ok := result.OneWayDelays(); ok {
+						labels := prometheus.Labels{"src": *bind, "dst": dst}
+						if result.Synchronized {
+							owdForward.With(labels).Observe(forward.Seconds())
+							owdReverse.With(labels).Observe(reverse.Seconds())
+							clockSynchronized.With(labels).Set(1)
+						} else {
+							clockSynchronized.With(labels).Set(0)
+						}
+
+						// Jitter is immune to clock offsets, as
+						// long as they do not change quickly.
+						jitterForward.With(labels).Set(forwardJitter.update(forward))
+						jitterReverse.With(labels).Set(reverseJitter.update(reverse))
+
+						offset, _ := result.ClockOffset()
+						clockOffset.With(labels).Set(offset.Seconds())
+					}
 				}
 
-				if err != nil && *verbose {
-					log.Printf("dst=%s err=%s", dst, err)
+				if errors.Is(err, ping.ErrImplausibleRTT) {
+					// The probe succeeded, but its RTT is
+					// not worth recording.
+					totalImplausible.With(prometheus.Labels{"src": *bind, "dst": dst}).Inc()
+				} else if err != nil {
+					totalFailures.With(prometheus.Labels{"src": *bind, "dst": dst, "reason": reason(err)}).Inc()
+
+					if *verbose {
+						log.Printf("dst=%s err=%s", dst, err)
+					}
 				}
 
 				totalRequests.With(prometheus.Labels{"src": *bind, "dst": dst}).Inc()
@@ -122,6 +817,39 @@ func main() {
 
 	http.Handle("/metrics", promhttp.Handler())
 
-	log.Printf("Serving metrics at http://%s:%s/metrics", *bind, strconv.Itoa(*port))
-	log.Fatal(http.ListenAndServe(*bind+":"+strconv.Itoa(*port), nil))
+	listenAddr := net.JoinHostPort(*bind, strconv.Itoa(*port))
+	srv := &http.Server{Addr: listenAddr}
+	go func() {
+		log.Printf("Serving metrics at http://%s/metrics", listenAddr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %s, shutting down", <-sig)
+
+	// Cancel outstanding probes and wait for them to return before
+	// closing the pinger.
+	cancel()
+	wg.Wait()
+	if pinger != nil {
+		pinger.Close()
+	}
+	if tracer != nil {
+		tracer.Close()
+	}
+	if prober != nil {
+		prober.Close()
+	}
+	if reflector != nil {
+		reflector.Close()
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Fatalln(err)
+	}
 }
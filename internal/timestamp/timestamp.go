@@ -1,21 +1,72 @@
 package timestamp
 
-import "time"
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
 
 // A Timestamp represents a point in time as the number of nanoseconds
 // elapsed since January 1, 1970 UTC.
 type Timestamp int64
 
+// ntpEpochOffset is the number of seconds between the NTP epoch, January
+// 1, 1900 UTC, and the Unix epoch.
+const ntpEpochOffset = 2208988800
+
 // Now returns the current timestamp.
 func Now() Timestamp {
 	return Timestamp(time.Now().UnixNano())
 }
 
+// FromTime returns the timestamp of t.
+func FromTime(t time.Time) Timestamp {
+	return Timestamp(t.UnixNano())
+}
+
+// FromNTP returns the timestamp of the 64-bit NTP timestamp ntp.
+func FromNTP(ntp uint64) Timestamp {
+	sec := int64(ntp>>32) - ntpEpochOffset
+	nsec := int64(((ntp&0xffffffff)*uint64(time.Second) + 1<<31) >> 32)
+	return Timestamp(sec*int64(time.Second) + nsec)
+}
+
 // Time returns the Time in UTC.
 func (t Timestamp) Time() time.Time {
 	return time.Unix(int64(t)/int64(time.Second), int64(t)%int64(time.Second)).UTC()
 }
 
+// NTP returns the timestamp in the 64-bit NTP format, with the seconds
+// since the NTP epoch in the upper 32 bits and the fraction of a second
+// in the lower 32 bits.
+func (t Timestamp) NTP() uint64 {
+	sec := int64(t) / int64(time.Second)
+	nsec := int64(t) % int64(time.Second)
+	if nsec < 0 {
+		sec, nsec = sec-1, nsec+int64(time.Second)
+	}
+	frac := (uint64(nsec) << 32) / uint64(time.Second)
+	return uint64(sec+ntpEpochOffset)<<32 | frac
+}
+
+// MarshalNTP returns the timestamp in the 64-bit NTP format, in network
+// byte order.
+func (t Timestamp) MarshalNTP() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, t.NTP())
+	return buf
+}
+
+// UnmarshalNTP sets the timestamp from the first 8 bytes of data, which
+// hold a 64-bit NTP timestamp in network byte order.
+func (t *Timestamp) UnmarshalNTP(data []byte) error {
+	if len(data) < 8 {
+		return errors.New("ntp timestamp too short")
+	}
+	*t = FromNTP(binary.BigEndian.Uint64(data))
+	return nil
+}
+
 // MarshalBinary implements the encoding.BinaryMarshaler interface.
 func (t Timestamp) MarshalBinary() ([]byte, error) {
 	buf := make([]byte, 8)
@@ -12,3 +12,18 @@ func TestTimestamp(t *testing.T) {
 		t.Errorf("unexpected result: got %d, want %d", ts2, ts)
 	}
 }
+
+func TestTimestampNTP(t *testing.T) {
+	ts := Now()
+	ts2 := new(Timestamp)
+	ts2.UnmarshalNTP(ts.MarshalNTP())
+
+	if int64(ts) != int64(*ts2) {
+		t.Errorf("unexpected result: got %d, want %d", ts2, ts)
+	}
+
+	// The Unix epoch is 2208988800 seconds after the NTP epoch.
+	if ntp := Timestamp(0).NTP(); ntp != 2208988800<<32 {
+		t.Errorf("unexpected result: got %#x, want %#x", ntp, uint64(2208988800)<<32)
+	}
+}
@@ -0,0 +1,239 @@
+package ping
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// An RcodeError is returned when a DNS query is answered with a response
+// code other than NOERROR.
+type RcodeError struct {
+	Rcode layers.DNSResponseCode
+}
+
+var rcodeReasons = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeFormErr:  "formerr",
+	layers.DNSResponseCodeServFail: "servfail",
+	layers.DNSResponseCodeNXDomain: "nxdomain",
+	layers.DNSResponseCodeNotImp:   "notimp",
+	layers.DNSResponseCodeRefused:  "refused",
+}
+
+// Reason returns a short, label-friendly name of the response code, such
+// as "nxdomain".
+func (e *RcodeError) Reason() string {
+	if reason, ok := rcodeReasons[e.Rcode]; ok {
+		return reason
+	}
+	return fmt.Sprintf("rcode_%d", e.Rcode)
+}
+
+func (e *RcodeError) Error() string {
+	return fmt.Sprintf("dns response code %s", strings.ToUpper(e.Reason()))
+}
+
+type dnsPinger struct {
+	name    string
+	qtype   layers.DNSType
+	timeout time.Duration
+	src     net.IP
+	dialer  *net.Dialer
+	mu      *sync.Mutex
+	rand    *rand.Rand
+	stop    chan bool
+	once    *sync.Once
+}
+
+// NewDNS returns a Pinger that sends DNS queries to resolvers, over UDP
+// if the destination is a *net.UDPAddr, or over TCP if it is a
+// *net.TCPAddr. The query is set with WithQuery.
+//
+// Responses with a response code other than NOERROR are reported with
+// an RcodeError.
+func NewDNS(opts ...Option) (Pinger, error) {
+	cfg := newConfig(opts)
+	if cfg.query == "" {
+		return nil, errors.New("no query set")
+	}
+
+	return &dnsPinger{
+		name:    strings.TrimSuffix(cfg.query, "."),
+		qtype:   cfg.qtype,
+		timeout: cfg.timeout,
+		src:     cfg.src,
+		dialer:  &net.Dialer{Control: dialControl(cfg)},
+		mu:      new(sync.Mutex),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		stop:    make(chan bool),
+		once:    new(sync.Once),
+	}, nil
+}
+
+func (p *dnsPinger) Ping(dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(context.Background(), dst))
+}
+
+func (p *dnsPinger) PingContext(ctx context.Context, dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(ctx, dst))
+}
+
+func (p *dnsPinger) Probe(ctx context.Context, dst net.Addr) (*Result, error) {
+	var network string
+	var laddr net.Addr
+
+	// The source address may be of another address family.
+	switch dst := dst.(type) {
+	case *net.UDPAddr:
+		network = "udp"
+		if p.src != nil && (p.src.To4() == nil) == (dst.IP.To4() == nil) {
+			laddr = &net.UDPAddr{IP: p.src}
+		}
+	case *net.TCPAddr:
+		network = "tcp"
+		if p.src != nil && (p.src.To4() == nil) == (dst.IP.To4() == nil) {
+			laddr = &net.TCPAddr{IP: p.src}
+		}
+	default:
+		return nil, errors.New("dst must be a *net.UDPAddr or *net.TCPAddr")
+	}
+
+	select {
+	case <-p.stop:
+		return nil, ErrClosed
+	default:
+	}
+
+	p.mu.Lock()
+	id := uint16(p.rand.Uint32())
+	p.mu.Unlock()
+
+	query := &layers.DNS{
+		ID:      id,
+		OpCode:  layers.DNSOpCodeQuery,
+		RD:      true,
+		QDCount: 1,
+		Questions: []layers.DNSQuestion{{
+			Name:  []byte(p.name),
+			Type:  p.qtype,
+			Class: layers.DNSClassIN,
+		}},
+	}
+	req, err := packDNS(query)
+	if err != nil {
+		return nil, err
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	// The timeout includes setting up the TCP connection, but the RTT
+	// does not.
+	dialer := *p.dialer
+	dialer.LocalAddr = laddr
+	conn, err := dialer.DialContext(reqCtx, network, dst.String())
+	if err != nil {
+		return nil, dialError(p.stop, ctx, reqCtx, err)
+	}
+	defer conn.Close()
+
+	// Unblock the reads below once the probe is canceled or the pinger
+	// is closed.
+	deadline, _ := reqCtx.Deadline()
+	conn.SetDeadline(deadline)
+	go func() {
+		select {
+		case <-p.stop:
+		case <-reqCtx.Done():
+		}
+		conn.SetDeadline(time.Unix(1, 0))
+	}()
+
+	if network == "tcp" {
+		// Messages over TCP are prefixed with their length.
+		req = append([]byte{byte(len(req) >> 8), byte(len(req))}, req...)
+	}
+
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return nil, dialError(p.stop, ctx, reqCtx, err)
+	}
+
+	resp := make([]byte, 65535)
+	for {
+		var n int
+		if network == "tcp" {
+			var size [2]byte
+			if _, err = io.ReadFull(conn, size[:]); err == nil {
+				n, err = io.ReadFull(conn, resp[:binary.BigEndian.Uint16(size[:])])
+			}
+		} else {
+			n, err = conn.Read(resp)
+		}
+		if err != nil {
+			return nil, dialError(p.stop, ctx, reqCtx, err)
+		}
+		now := time.Now()
+
+		reply := new(layers.DNS)
+		if err := reply.DecodeFromBytes(resp[:n], gopacket.NilDecodeFeedback); err != nil {
+			continue
+		}
+		// Ignore stray responses to earlier queries.
+		if !reply.QR || reply.ID != id || len(reply.Questions) != 1 ||
+			!strings.EqualFold(string(reply.Questions[0].Name), p.name) || reply.Questions[0].Type != p.qtype {
+			continue
+		}
+
+		result := &Result{
+			Seq:      int(id),
+			Addr:     conn.RemoteAddr(),
+			TTL:      -1,
+			Size:     n,
+			Sent:     sent,
+			Received: now,
+			RTT:      now.Sub(sent),
+		}
+		switch addr := conn.LocalAddr().(type) {
+		case *net.UDPAddr:
+			result.Local = addr.IP
+		case *net.TCPAddr:
+			result.Local = addr.IP
+		}
+
+		if reply.ResponseCode != layers.DNSResponseCodeNoErr {
+			return result, &RcodeError{reply.ResponseCode}
+		}
+		return result, checkRTT(result.RTT, p.timeout)
+	}
+}
+
+// packDNS serializes msg. gopacket encodes the root name with an extra
+// empty label, so it is fixed up if the question is for the root, which
+// is only correct as long as msg has no other records.
+func packDNS(msg *layers.DNS) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	if err := msg.SerializeTo(buf, gopacket.SerializeOptions{}); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	if len(msg.Questions) == 1 && len(msg.Questions[0].Name) == 0 {
+		// The question follows the 12 byte header.
+		b = append(b[:12], b[13:]...)
+	}
+	return b, nil
+}
+
+func (p *dnsPinger) Close() error {
+	return closeOnce(p.once, p.stop)
+}
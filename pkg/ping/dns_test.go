@@ -0,0 +1,136 @@
+package ping
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// answerDNS returns the response to the query in b, with NXDOMAIN for
+// names other than example.com.
+func answerDNS(b []byte) []byte {
+	msg := new(layers.DNS)
+	if err := msg.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+		return nil
+	}
+	msg.QR = true
+	if string(msg.Questions[0].Name) != "example.com" {
+		msg.ResponseCode = layers.DNSResponseCodeNXDomain
+	}
+
+	resp, _ := packDNS(msg)
+	return resp
+}
+
+// serveDNS answers queries on conn.
+func serveDNS(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := answerDNS(buf[:n]); resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// serveDNSTCP answers queries on the connections accepted by ln.
+func serveDNSTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var size [2]byte
+			for {
+				if _, err := io.ReadFull(conn, size[:]); err != nil {
+					return
+				}
+				buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				if resp := answerDNS(buf); resp != nil {
+					conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+				}
+			}
+		}()
+	}
+}
+
+func TestDNSProbe(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveDNS(conn)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveDNSTCP(ln)
+
+	for _, dst := range []net.Addr{conn.LocalAddr(), ln.Addr()} {
+		for _, tt := range []struct {
+			name  string
+			rcode layers.DNSResponseCode
+		}{
+			{"example.com.", layers.DNSResponseCodeNoErr},
+			{"missing.example.com", layers.DNSResponseCodeNXDomain},
+			{".", layers.DNSResponseCodeNXDomain},
+		} {
+			p, err := NewDNS(WithTimeout(time.Second), WithQuery(tt.name, layers.DNSTypeA))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := p.Probe(context.Background(), dst)
+			p.Close()
+			if result == nil || result.RTT <= 0 {
+				t.Errorf("%s %s: unexpected result: %+v", dst.Network(), tt.name, result)
+			}
+
+			var rcodeErr *RcodeError
+			switch {
+			case tt.rcode == layers.DNSResponseCodeNoErr && err != nil:
+				t.Errorf("%s %s: unexpected error: %s", dst.Network(), tt.name, err)
+			case tt.rcode != layers.DNSResponseCodeNoErr && (!errors.As(err, &rcodeErr) || rcodeErr.Rcode != tt.rcode):
+				t.Errorf("%s %s: unexpected error: got %v, want rcode %s", dst.Network(), tt.name, err, tt.rcode)
+			}
+		}
+	}
+}
+
+func TestDNSProbeSourceFamily(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveDNS(conn)
+
+	// The IPv6 source address does not apply to IPv4 resolvers.
+	p, err := NewDNS(WithTimeout(time.Second), WithQuery("example.com", layers.DNSTypeA), WithSource(net.IPv6loopback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if _, err := p.Probe(context.Background(), conn.LocalAddr()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,146 @@
+package ping
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	// ErrTimeout is returned when no reply is received in time.
+	ErrTimeout = errors.New("timeout")
+
+	// ErrDestinationUnreachable matches ICMP destination unreachable
+	// errors.
+	ErrDestinationUnreachable = errors.New("destination unreachable")
+
+	// ErrTimeExceeded matches ICMP time exceeded errors.
+	ErrTimeExceeded = errors.New("time exceeded")
+
+	// ErrPacketTooBig matches ICMPv6 packet too big errors, as well as
+	// ICMP fragmentation needed errors.
+	ErrPacketTooBig = errors.New("packet too big")
+
+	// ErrPortClosed is returned when the destination port refuses
+	// connections.
+	ErrPortClosed = errors.New("port closed")
+
+	// ErrImplausibleRTT is returned along with the result when the
+	// measured RTT is negative or exceeds the timeout, which means the
+	// sample should be discarded.
+	ErrImplausibleRTT = errors.New("implausible rtt")
+)
+
+// An ICMPError is returned when a probe is answered with an ICMP error
+// message. It matches the corresponding sentinel error with errors.Is.
+type ICMPError struct {
+	Type  icmp.Type  // ICMP type, either ipv4.ICMPType or ipv6.ICMPType
+	Code  int        // ICMP code
+	From  net.Addr   // Address of the router that sent the error
+	Dst   net.IP     // Destination of the original probe
+	Probe *icmp.Echo // Request that triggered the error, only ID and Seq for timestamp requests
+	MTU   int        // MTU of the next hop for packet too big errors, 0 if unknown
+
+	// Extension objects of RFC 4884 carried by time exceeded and
+	// destination unreachable errors, such as *icmp.MPLSLabelStack and
+	// *icmp.InterfaceInfo.
+	Extensions []icmp.Extension
+}
+
+// MPLSLabels returns the MPLS label stack of the probe, as received by
+// the router which sent the error, from the top of the stack. It is nil
+// unless the error carries the extension of RFC 4950.
+func (e *ICMPError) MPLSLabels() []icmp.MPLSLabel {
+	var labels []icmp.MPLSLabel
+	for _, ext := range e.Extensions {
+		if ls, ok := ext.(*icmp.MPLSLabelStack); ok {
+			labels = append(labels, ls.Labels...)
+		}
+	}
+	return labels
+}
+
+// Interfaces returns the interface information of RFC 5837 carried by
+// the error, which identifies the interfaces of the router the probe
+// arrived on or would have left by, and the next hop.
+func (e *ICMPError) Interfaces() []*icmp.InterfaceInfo {
+	var ifis []*icmp.InterfaceInfo
+	for _, ext := range e.Extensions {
+		if ifi, ok := ext.(*icmp.InterfaceInfo); ok {
+			ifis = append(ifis, ifi)
+		}
+	}
+	return ifis
+}
+
+var icmpReasons = map[icmp.Type]map[int]string{
+	ipv4.ICMPTypeDestinationUnreachable: {
+		0:  "net_unreachable",
+		1:  "host_unreachable",
+		2:  "protocol_unreachable",
+		3:  "port_unreachable",
+		4:  "fragmentation_needed",
+		5:  "source_route_failed",
+		6:  "net_unknown",
+		7:  "host_unknown",
+		9:  "net_prohibited",
+		10: "host_prohibited",
+		13: "admin_prohibited",
+	},
+	ipv4.ICMPTypeTimeExceeded: {
+		0: "ttl_exceeded",
+		1: "reassembly_time_exceeded",
+	},
+	ipv6.ICMPTypeDestinationUnreachable: {
+		0: "no_route",
+		1: "admin_prohibited",
+		2: "beyond_scope",
+		3: "address_unreachable",
+		4: "port_unreachable",
+		5: "source_policy_failed",
+		6: "reject_route",
+	},
+	ipv6.ICMPTypeTimeExceeded: {
+		0: "hop_limit_exceeded",
+		1: "reassembly_time_exceeded",
+	},
+	ipv6.ICMPTypePacketTooBig: {
+		0: "packet_too_big",
+	},
+}
+
+// Reason returns a short, label-friendly description of the ICMP type
+// and code, such as "host_unreachable".
+func (e *ICMPError) Reason() string {
+	if reason, ok := icmpReasons[e.Type][e.Code]; ok {
+		return reason
+	}
+	return fmt.Sprintf("type_%d_code_%d", e.Type, e.Code)
+}
+
+func (e *ICMPError) Error() string {
+	if e.From == nil {
+		return fmt.Sprintf("%s (%s)", e.Type, e.Reason())
+	}
+	return fmt.Sprintf("%s (%s) from %s", e.Type, e.Reason(), e.From)
+}
+
+// Is reports whether e matches the sentinel error target.
+func (e *ICMPError) Is(target error) bool {
+	switch e.Type {
+	case ipv4.ICMPTypeDestinationUnreachable:
+		return target == ErrDestinationUnreachable || e.Code == 4 && target == ErrPacketTooBig
+	case ipv6.ICMPTypeDestinationUnreachable:
+		return target == ErrDestinationUnreachable
+	case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+		return target == ErrTimeExceeded
+	case ipv6.ICMPTypePacketTooBig:
+		return target == ErrPacketTooBig
+	default:
+		return false
+	}
+}
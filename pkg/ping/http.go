@@ -0,0 +1,229 @@
+package ping
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A URL is the address of an HTTP or HTTPS endpoint.
+type URL struct {
+	url.URL
+}
+
+// ParseURL parses s into a URL, which must be absolute and use the http
+// or https scheme.
+func ParseURL(s string) (*URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("missing host")
+	}
+
+	return &URL{*u}, nil
+}
+
+// Network returns the scheme of the URL.
+func (u *URL) Network() string {
+	return u.Scheme
+}
+
+// HTTPTimings breaks down the time taken by an HTTP request. Phases that
+// did not take place, such as DNS for IP literals or the TLS handshake
+// for plain HTTP, are zero.
+type HTTPTimings struct {
+	DNS          time.Duration // Resolving the host name
+	Connect      time.Duration // Establishing the TCP connection
+	TLSHandshake time.Duration // Performing the TLS handshake
+	FirstByte    time.Duration // From the start to the first byte of the response
+	Total        time.Duration // From the start to the end of the response body
+}
+
+// An HTTPStatusError is returned when the server responds with a client
+// or server error status code.
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("http status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+type httpPinger struct {
+	method  string
+	timeout time.Duration
+	dialer  *net.Dialer
+	tls     *tls.Config
+	stop    chan bool
+	once    *sync.Once
+}
+
+// NewHTTP returns a Pinger that sends HTTP requests to URLs. Each probe
+// uses a new connection, so that the timings include name resolution,
+// connection setup and the TLS handshake. Redirects are not followed.
+//
+// Responses with status codes of 400 and above are reported with an
+// HTTPStatusError.
+func NewHTTP(opts ...Option) (Pinger, error) {
+	cfg := newConfig(opts)
+
+	dialer := &net.Dialer{Control: dialControl(cfg)}
+	if cfg.src != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: cfg.src}
+	}
+
+	return &httpPinger{
+		method:  cfg.method,
+		timeout: cfg.timeout,
+		dialer:  dialer,
+		tls:     cfg.tls,
+		stop:    make(chan bool),
+		once:    new(sync.Once),
+	}, nil
+}
+
+func (p *httpPinger) Ping(dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(context.Background(), dst))
+}
+
+func (p *httpPinger) PingContext(ctx context.Context, dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(ctx, dst))
+}
+
+func (p *httpPinger) Probe(ctx context.Context, dst net.Addr) (*Result, error) {
+	u, ok := dst.(*URL)
+	if !ok {
+		return nil, errors.New("dst must be a *URL")
+	}
+
+	select {
+	case <-p.stop:
+		return nil, ErrClosed
+	default:
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-reqCtx.Done():
+		}
+	}()
+
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		// The source address may be of another address family. Host
+		// names are only resolved to addresses of its family.
+		dialer := *p.dialer
+		host, _, _ := net.SplitHostPort(address)
+		if src, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+			if ip := net.ParseIP(host); ip != nil && (ip.To4() == nil) != (src.IP.To4() == nil) {
+				dialer.LocalAddr = nil
+			}
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	transport := &http.Transport{
+		DialContext:       dial,
+		TLSClientConfig:   p.tls,
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	result := &Result{TTL: -1}
+	timings := new(HTTPTimings)
+	var dnsStart, tlsStart time.Time
+
+	// With Happy Eyeballs, connections to several addresses may be
+	// attempted in parallel. Only the one that succeeded is timed.
+	mu := new(sync.Mutex)
+	connectStart := make(map[string]time.Time)
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			timings.DNS = time.Since(dnsStart)
+		},
+		ConnectStart: func(_, addr string) {
+			mu.Lock()
+			connectStart[addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(_, addr string, err error) {
+			mu.Lock()
+			if err == nil {
+				timings.Connect = time.Since(connectStart[addr])
+			}
+			mu.Unlock()
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			timings.TLSHandshake = time.Since(tlsStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			result.Addr = info.Conn.RemoteAddr()
+			if addr, ok := info.Conn.LocalAddr().(*net.TCPAddr); ok {
+				result.Local = addr.IP
+			}
+		},
+		GotFirstResponseByte: func() {
+			result.Received = time.Now()
+		},
+	}
+
+	req, err := http.NewRequest(p.method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(httptrace.WithClientTrace(reqCtx, trace))
+
+	result.Sent = time.Now()
+	resp, err := client.Do(req)
+	if err == nil {
+		var n int64
+		n, err = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		result.Size = int(n)
+	}
+	if err != nil {
+		return nil, dialError(p.stop, ctx, reqCtx, err)
+	}
+
+	timings.Total = time.Since(result.Sent)
+	if !result.Received.IsZero() {
+		timings.FirstByte = result.Received.Sub(result.Sent)
+	}
+	result.RTT = timings.Total
+	result.StatusCode = resp.StatusCode
+	result.HTTP = timings
+
+	if resp.StatusCode >= 400 {
+		return result, &HTTPStatusError{resp.StatusCode}
+	}
+	return result, nil
+}
+
+func (p *httpPinger) Close() error {
+	return closeOnce(p.once, p.stop)
+}
@@ -0,0 +1,94 @@
+package ping
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPProbe(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("pong"))
+	})
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsSrv.Certificate())
+	p, err := NewHTTP(WithTimeout(time.Second), WithTLSConfig(&tls.Config{RootCAs: roots}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for _, s := range []string{srv.URL, tlsSrv.URL} {
+		u, err := ParseURL(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := p.Probe(context.Background(), u)
+		if err != nil {
+			t.Fatalf("probe %s: %s", u, err)
+		}
+		if result.StatusCode != http.StatusOK || result.Size != 4 {
+			t.Errorf("unexpected response: status %d, size %d", result.StatusCode, result.Size)
+		}
+
+		timings := result.HTTP
+		if timings.Connect <= 0 || timings.FirstByte <= 0 || timings.Total < timings.FirstByte {
+			t.Errorf("unexpected timings: %+v", timings)
+		}
+		if (timings.TLSHandshake > 0) != (u.Scheme == "https") {
+			t.Errorf("unexpected tls handshake time: %s", timings.TLSHandshake)
+		}
+	}
+
+	u, _ := ParseURL(srv.URL + "/missing")
+	var statusErr *HTTPStatusError
+	if _, err := p.Probe(context.Background(), u); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected error: got %v, want status %d", err, http.StatusNotFound)
+	}
+}
+
+func TestHTTPProbeErrors(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 unavailable:", err)
+	}
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	// The IPv4 source address does not apply to IPv6 destinations.
+	p, err := NewHTTP(WithTimeout(time.Second), WithSource(net.IPv4(127, 0, 0, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	u, _ := ParseURL(srv.URL)
+	var statusErr *HTTPStatusError
+	if _, err := p.Probe(context.Background(), u); !errors.As(err, &statusErr) {
+		t.Errorf("unexpected error: got %v, want status %d", err, http.StatusNotFound)
+	}
+
+	srv.Close()
+	if _, err := p.Probe(context.Background(), u); err != ErrPortClosed {
+		t.Errorf("unexpected error: got %v, want %v", err, ErrPortClosed)
+	}
+}
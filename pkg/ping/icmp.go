@@ -1,6 +1,8 @@
 package ping
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"log"
 	"math/rand"
@@ -12,6 +14,12 @@ import (
 	"github.com/ericyan/pingd/internal/timestamp"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	protocolICMP     = ipv4.ICMPTypeEchoReply.Protocol()
+	protocolIPv6ICMP = ipv6.ICMPTypeEchoReply.Protocol()
 )
 
 type message struct {
@@ -22,177 +30,498 @@ type message struct {
 	err  error
 }
 
-func parseMessage(buf []byte) *message {
-	// Record receive time asap
-	now := time.Now()
+// parseEmbedded parses the original datagram carried in an ICMP error
+// message and returns its destination and the echo request it contains.
+// For timestamp requests, an echo request with the same ID and sequence
+// number is returned.
+func parseEmbedded(proto int, data []byte) (net.IP, *icmp.Echo, error) {
+	var hlen, next int
+	var dst net.IP
+	var typ icmp.Type
+	if proto == protocolIPv6ICMP {
+		if len(data) < ipv6.HeaderLen {
+			return nil, nil, errors.New("original datagram too short")
+		}
+		hlen, next, dst, typ = ipv6.HeaderLen, int(data[6]), net.IP(data[24:40]), ipv6.ICMPTypeEchoRequest
+	} else {
+		if len(data) < ipv4.HeaderLen {
+			return nil, nil, errors.New("original datagram too short")
+		}
+		hlen, next, dst, typ = int(data[0]&0x0f)<<2, int(data[9]), net.IP(data[16:20]), ipv4.ICMPTypeEcho
+	}
+	if len(data) < hlen {
+		return nil, nil, errors.New("original datagram too short")
+	}
+	// Errors about UDP or TCP packets which happen to look like ICMP
+	// messages are not about our probes.
+	if next != proto {
+		return nil, nil, errors.New("original datagram is not an icmp message")
+	}
 
-	msg, err := icmp.ParseMessage(ipv4.ICMPTypeEchoReply.Protocol(), buf)
+	msg, err := icmp.ParseMessage(proto, data[hlen:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if body, ok := msg.Body.(*icmp.DefaultMessageBody); ok && msg.Type == ipv4.ICMPTypeTimestamp && len(body.Data) >= 4 {
+		// Only the first 8 bytes of the timestamp request may be
+		// included, but those hold the ID and sequence number.
+		return append(net.IP(nil), dst...), &icmp.Echo{
+			ID:  int(binary.BigEndian.Uint16(body.Data[0:2])),
+			Seq: int(binary.BigEndian.Uint16(body.Data[2:4])),
+		}, nil
+	}
+	req, ok := msg.Body.(*icmp.Echo)
+	if !ok || msg.Type != typ {
+		return nil, nil, errors.New("original datagram is not an echo request")
+	}
+
+	return append(net.IP(nil), dst...), req, nil
+}
+
+// parseMessage parses an ICMP message received at time now.
+func parseMessage(proto int, buf []byte, from net.Addr, now time.Time) *message {
+	msg, err := icmp.ParseMessage(proto, buf)
 	if err != nil {
 		return &message{now, 0, 0, nil, err}
 	}
 
 	switch msg.Type {
-	case ipv4.ICMPTypeEchoReply:
+	case ipv4.ICMPTypeEchoReply, ipv6.ICMPTypeEchoReply:
 		reply, ok := msg.Body.(*icmp.Echo)
 		if !ok {
 			return &message{now, 0, 0, nil, errors.New("type assertion failed")}
 		}
 
 		return &message{now, reply.ID, reply.Seq, msg.Body, nil}
-	case ipv4.ICMPTypeEcho:
-		// Ignore echo requests
-		return &message{now, 0, 0, nil, nil}
-	case ipv4.ICMPTypeDestinationUnreachable:
-		reply, ok := msg.Body.(*icmp.DstUnreach)
-		if !ok {
-			return &message{now, 0, 0, nil, errors.New("type assertion failed")}
-		}
-
-		msg, err := icmp.ParseMessage(ipv4.ICMPTypeEchoReply.Protocol(), reply.Data[ipv4.HeaderLen:])
+	case ipv4.ICMPTypeTimestampReply:
+		reply, err := parseTimestampBody(msg.Body)
 		if err != nil {
 			return &message{now, 0, 0, nil, err}
 		}
-		req := msg.Body.(*icmp.Echo)
 
-		return &message{now, req.ID, req.Seq, msg.Body, errors.New("destination unreachable")}
-	case ipv4.ICMPTypeTimeExceeded:
-		reply, ok := msg.Body.(*icmp.TimeExceeded)
-		if !ok {
+		return &message{now, reply.ID, reply.Seq, reply, nil}
+	case ipv4.ICMPTypeEcho, ipv6.ICMPTypeEchoRequest, ipv4.ICMPTypeTimestamp:
+		// Ignore requests
+		return &message{now, 0, 0, nil, nil}
+	case ipv4.ICMPTypeDestinationUnreachable, ipv6.ICMPTypeDestinationUnreachable,
+		ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded,
+		ipv6.ICMPTypePacketTooBig:
+		var data []byte
+		var exts []icmp.Extension
+		switch body := msg.Body.(type) {
+		case *icmp.DstUnreach:
+			data, exts = body.Data, body.Extensions
+		case *icmp.TimeExceeded:
+			data, exts = body.Data, body.Extensions
+		case *icmp.PacketTooBig:
+			data = body.Data
+		default:
 			return &message{now, 0, 0, nil, errors.New("type assertion failed")}
 		}
 
-		msg, err := icmp.ParseMessage(ipv4.ICMPTypeEchoReply.Protocol(), reply.Data[ipv4.HeaderLen:])
+		dst, req, err := parseEmbedded(proto, data)
 		if err != nil {
-			return &message{now, 0, 0, nil, err}
+			// Not a response to an echo request, ignore it
+			return &message{now, 0, 0, nil, nil}
 		}
-		req := msg.Body.(*icmp.Echo)
 
-		return &message{now, req.ID, req.Seq, msg.Body, errors.New("time exceeded")}
+		var mtu int
+		switch {
+		case msg.Type == ipv4.ICMPTypeDestinationUnreachable && msg.Code == 4:
+			// The next-hop MTU of RFC 1191 takes the place of the
+			// lower half of the unused field.
+			mtu = int(binary.BigEndian.Uint16(buf[6:8]))
+		case msg.Type == ipv6.ICMPTypePacketTooBig:
+			mtu = msg.Body.(*icmp.PacketTooBig).MTU
+		}
+
+		return &message{now, req.ID, req.Seq, req, &ICMPError{
+			Type:       msg.Type,
+			Code:       msg.Code,
+			From:       from,
+			Dst:        dst,
+			Probe:      req,
+			MTU:        mtu,
+			Extensions: exts,
+		}}
 	default:
 		return &message{now, 0, 0, nil, nil}
 	}
 }
 
+// flowOffset is the offset of the two bytes of echo requests which are
+// set by setFlow. They follow the send timestamp in the payload.
+const flowOffset = 16
+
+// setFlow sets the bytes of the marshaled echo request b at flowOffset so
+// that its checksum only depends on the flow, as Paris traceroute does.
+// Routers balancing load across equal-cost paths may hash the checksum,
+// as it is at the same place as the ports of UDP and TCP, so this keeps
+// all probes of a flow on the same path even though their sequence
+// numbers and timestamps differ.
+//
+// The checksum of ICMPv6 messages, which is computed by the kernel, also
+// covers the addresses of the packet, but those are the same for all
+// probes to a destination.
+func setFlow(b []byte, v6 bool, flow int) {
+	b[2], b[3] = 0, 0
+	b[flowOffset], b[flowOffset+1] = 0, 0
+
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+
+	// Make the one's complement sum of the message, excluding the
+	// checksum, equal to the target, which must not be 0.
+	target := uint32(flow)%0xffff + 1
+	c := target + ^sum&0xffff
+	for c > 0xffff {
+		c = c&0xffff + c>>16
+	}
+	binary.BigEndian.PutUint16(b[flowOffset:], uint16(c))
+
+	if !v6 {
+		binary.BigEndian.PutUint16(b[2:], ^uint16(target))
+	}
+}
+
+// A reply is a message received by the pinger, along with information
+// about the packet that carried it.
+type reply struct {
+	*message
+	size int
+	from net.Addr
+	cm   *controlMessage
+}
+
 type icmpPinger struct {
-	id   int
-	seq  uint64
-	conn *icmp.PacketConn
-	mu   *sync.Mutex
-	recv map[int]chan *message
-	stop chan bool
+	id        int
+	seq       uint64
+	dgram     bool
+	conn4     net.PacketConn
+	conn6     net.PacketConn
+	ts4       *timestamper
+	ts6       *timestamper
+	ttlMu     *sync.Mutex // Serializes sends with a TTL set per probe
+	timestamp bool        // Whether to send timestamp requests instead of echo requests
+	recv      *inflightSet
+	stop      chan bool
+	once      *sync.Once
+	timeout   time.Duration
+	payload   []byte
+}
 
-	Timeout uint // Timeout in milliseconds
+// listenICMP opens an ICMP or ICMPv6 endpoint using raw or
+// datagram-oriented sockets, and applies the options in cfg to it.
+func listenICMP(v6, dgram bool, cfg *config) (net.PacketConn, error) {
+	src := sourceAddr(v6, cfg)
+
+	var conn net.PacketConn
+	var err error
+	switch {
+	case dgram:
+		conn, err = listenDatagram(src)
+	case v6:
+		conn, err = net.ListenPacket("ip6:ipv6-icmp", src.String())
+	default:
+		conn, err = net.ListenPacket("ip4:icmp", src.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setSockopts(conn, v6, cfg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
 }
 
-func NewICMP() (Pinger, error) {
+// NewICMP returns a Pinger that sends ICMP and ICMPv6 echo requests.
+// The ICMPv6 endpoint is optional: if it cannot be opened, pinging
+// IPv6 destinations will fail but IPv4 destinations still work.
+//
+// By default, raw sockets are used if the process is allowed to open
+// them, otherwise it falls back to datagram-oriented sockets. Note that
+// ICMP errors such as destination unreachable are not delivered to
+// datagram-oriented sockets, so they are reported as timeouts.
+func NewICMP(opts ...Option) (Pinger, error) {
+	cfg := newConfig(opts)
+
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	dgram := cfg.socketType == SocketDatagram
+	conn4, err := listenICMP(false, dgram, cfg)
+	if err != nil && cfg.socketType == SocketAuto {
+		log.Printf("Raw ICMP socket unavailable, using datagram socket: %s", err)
+		dgram = true
+		conn4, err = listenICMP(false, dgram, cfg)
+	}
 	if err != nil {
 		return nil, err
 	}
+	conn6, err := listenICMP(true, dgram, cfg)
+	if err != nil {
+		log.Printf("ICMPv6 unavailable: %s", err)
+		conn6 = nil
+	} else if !dgram {
+		// Raw ICMPv6 sockets see all neighbor discovery traffic,
+		// only let through messages we could possibly care about.
+		var f ipv6.ICMPFilter
+		f.SetAll(true)
+		f.Accept(ipv6.ICMPTypeEchoReply)
+		f.Accept(ipv6.ICMPTypeDestinationUnreachable)
+		f.Accept(ipv6.ICMPTypePacketTooBig)
+		f.Accept(ipv6.ICMPTypeTimeExceeded)
+		ipv6.NewPacketConn(conn6).SetICMPFilter(&f)
+	}
+
+	return newICMPPinger(cfg, r.Int63(), dgram, conn4, conn6), nil
+}
+
+// newICMPPinger returns an icmpPinger reading from and writing to the
+// given endpoints. Conn6 may be nil if ICMPv6 is unavailable.
+func newICMPPinger(cfg *config, id int64, dgram bool, conn4, conn6 net.PacketConn) *icmpPinger {
+	payload := newPayload(cfg)
+
 	p := &icmpPinger{
-		id:      int(r.Int63() & 0xffff),
+		id:      int(id & 0xffff),
 		seq:     0,
-		conn:    conn,
-		mu:      new(sync.Mutex),
-		recv:    make(map[int]chan *message),
+		dgram:   dgram,
+		conn4:   conn4,
+		conn6:   conn6,
+		ttlMu:   new(sync.Mutex),
+		recv:    newInflightSet(),
 		stop:    make(chan bool),
-		Timeout: 5000,
-	}
-
-	go func(p *icmpPinger) {
-		buf := make([]byte, 1500)
-		for {
-			select {
-			default:
-				p.conn.SetReadDeadline(time.Now().Add(time.Duration(p.Timeout) * time.Millisecond))
-
-				n, _, err := p.conn.ReadFrom(buf)
-				if err != nil {
-					// Ignore read timeout errors
-					if neterr, ok := err.(*net.OpError); ok {
-						if neterr.Timeout() {
-							continue
-						}
-					}
-
-					log.Println(err)
-					continue
-				}
+		once:    new(sync.Once),
+		timeout: cfg.timeout,
+		payload: payload,
+	}
 
-				result := parseMessage(buf[:n])
-				if result.body != nil || result.err != nil {
-					// Ignore messages intended for other pingers
-					if result.id != p.id {
-						continue
-					}
+	// Set up the readers before returning, so that timestamps and control
+	// messages are enabled for the replies to the very first probe.
+	p.ts4 = newTimestamper(conn4, cfg.hwTimestamp)
+	go p.listen(p.conn4, protocolICMP, newPacketReader(p.conn4, false))
+	if p.conn6 != nil {
+		p.ts6 = newTimestamper(conn6, cfg.hwTimestamp)
+		go p.listen(p.conn6, protocolIPv6ICMP, newPacketReader(p.conn6, true))
+	}
 
-					if c, ok := p.recv[result.seq]; ok {
-						c <- result
-					}
-				}
-			case <-p.stop:
-				close(p.stop)
-				return
-			}
-		}
-	}(p)
+	return p
+}
+
+func (p *icmpPinger) listen(conn net.PacketConn, proto int, read packetReader) {
+	// With datagram-oriented sockets, the kernel replaces the echo ID
+	// with the local port of the socket and only delivers replies
+	// matching it.
+	id := p.id
+	if p.dgram {
+		id = conn.LocalAddr().(*net.UDPAddr).Port
+	}
 
-	return p, nil
+	readPackets(conn, read, p.timeout, p.stop, func(b []byte, cm *controlMessage, from net.Addr) {
+		result := parseMessage(proto, b, from, cm.Time)
+		// Ignore messages intended for other pingers
+		if (result.body != nil || result.err != nil) && result.id == id {
+			p.recv.deliver(result.seq, &reply{result, len(b), from, cm})
+		}
+	})
 }
 
 func (p *icmpPinger) Ping(dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(context.Background(), dst))
+}
+
+func (p *icmpPinger) PingContext(ctx context.Context, dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(ctx, dst))
+}
+
+func (p *icmpPinger) Probe(ctx context.Context, dst net.Addr) (*Result, error) {
+	return p.probe(ctx, dst, probeOptions{})
+}
+
+// probeOptions modify the echo request sent by probe.
+type probeOptions struct {
+	// TTL or hop limit, unless 0. The pinger must not be used for
+	// probes with and without a TTL at the same time.
+	ttl int
+
+	// Flow of probes with a TTL, which share the checksum with the
+	// other probes of the same flow, see setFlow.
+	flow int
+
+	// Size of the payload, unless 0.
+	size int
+}
+
+// probe is like Probe, but sends the echo request as modified by opts.
+func (p *icmpPinger) probe(ctx context.Context, dst net.Addr, opts probeOptions) (*Result, error) {
 	dstAddr, ok := dst.(*net.IPAddr)
 	if !ok {
-		return 0, errors.New("dst must be a *net.IPAddr")
+		return nil, errors.New("dst must be a *net.IPAddr")
+	}
+
+	select {
+	case <-p.stop:
+		return nil, ErrClosed
+	default:
+	}
+
+	v6 := dstAddr.IP.To4() == nil
+	ts, typ := p.ts4, icmp.Type(ipv4.ICMPTypeEcho)
+	if v6 {
+		if p.conn6 == nil {
+			return nil, errors.New("ipv6 unavailable")
+		}
+		ts, typ = p.ts6, ipv6.ICMPTypeEchoRequest
 	}
 
 	seq := int(atomic.AddUint64(&p.seq, 1) & 0xffff)
 
-	p.mu.Lock()
-	p.recv[seq] = make(chan *message)
-	defer func() {
-		close(p.recv[seq])
-		delete(p.recv, seq)
-		p.mu.Unlock()
-	}()
+	e := new(inflight)
+	if err := p.recv.add(seq, e); err != nil {
+		return nil, err
+	}
+	defer p.recv.remove(seq)
+
+	size := len(p.payload)
+	if opts.size > 0 {
+		size = opts.size
+	}
+	payload := make([]byte, size)
+	copy(payload, p.payload)
+	sent := timestamp.Now()
+	b, _ := sent.MarshalBinary()
+	copy(payload, b)
 
-	payload := make([]byte, 56)
-	ts, _ := timestamp.Now().MarshalBinary()
-	copy(payload, ts)
+	var body icmp.MessageBody = &icmp.Echo{
+		ID:   p.id,
+		Seq:  seq,
+		Data: payload,
+	}
+	originate := msSinceMidnight(time.Now())
+	if p.timestamp {
+		typ, body = ipv4.ICMPTypeTimestamp, &timestampBody{
+			ID:        p.id,
+			Seq:       seq,
+			Originate: originate,
+		}
+	}
 
+	// The kernel computes the checksum for ICMPv6 messages.
 	req, err := (&icmp.Message{
-		Type: ipv4.ICMPTypeEcho,
+		Type: typ,
 		Code: 0,
-		Body: &icmp.Echo{
-			ID:   p.id,
-			Seq:  seq,
-			Data: payload,
-		},
+		Body: body,
 	}).Marshal(nil)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-
-	if _, err := p.conn.WriteTo(req, dstAddr); err != nil {
-		return 0, err
+	if opts.ttl > 0 {
+		setFlow(req, v6, opts.flow)
 	}
 
-	select {
-	case reply := <-p.recv[seq]:
-		if reply.err != nil {
-			return 0, reply.err
+	var addr net.Addr = dstAddr
+	if p.dgram {
+		addr = &net.UDPAddr{IP: dstAddr.IP, Zone: dstAddr.Zone}
+	}
+	if opts.ttl > 0 {
+		p.ttlMu.Lock()
+		if v6 {
+			err = ipv6.NewPacketConn(ts.conn).SetHopLimit(opts.ttl)
+		} else {
+			err = ipv4.NewPacketConn(ts.conn).SetTTL(opts.ttl)
 		}
-		t := new(timestamp.Timestamp)
-		t.UnmarshalBinary(reply.body.(*icmp.Echo).Data[:8])
+		if err != nil {
+			p.ttlMu.Unlock()
+			return nil, err
+		}
+	}
+	// Unlike the timestamp in the payload, e.sent is not subject to
+	// wall clock steps.
+	e.sent = time.Now()
+	id, err := ts.WriteTo(req, addr)
+	if opts.ttl > 0 {
+		p.ttlMu.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer ts.Sent(id)
 
-		return reply.t.Sub(t.Time()), nil
-	case <-time.After(time.Duration(p.Timeout) * time.Millisecond):
-		return 0, errors.New("timeout")
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case v := <-e.ch:
+			reply := v.(*reply)
+			result := &Result{
+				Seq:            seq,
+				Addr:           reply.from,
+				Local:          reply.cm.Dst,
+				TTL:            reply.cm.TTL,
+				Size:           reply.size,
+				Received:       reply.t,
+				ReceivedSource: reply.cm.TimeSource,
+			}
+
+			if reply.err != nil {
+				result.Sent, result.SentSource, result.RTT = ts.RoundTrip(id, e.sent, reply.cm)
+				return result, reply.err
+			}
+
+			// The timestamp in the payload, or the originate
+			// timestamp of timestamp replies, is only used to tell
+			// whether the reply belongs to this probe, or to an
+			// earlier one which used the same sequence number.
+			var stale bool
+			switch body := reply.body.(type) {
+			case *icmp.Echo:
+				if len(body.Data) < 8 {
+					return nil, errors.New("reply too short")
+				}
+				t := new(timestamp.Timestamp)
+				t.UnmarshalBinary(body.Data[:8])
+				stale = *t != sent
+			case *timestampBody:
+				stale = body.Originate != originate
+			}
+			if stale {
+				p.recv.markDup(e)
+				continue
+			}
+
+			result.Sent, result.SentSource, result.RTT = ts.RoundTrip(id, e.sent, reply.cm)
+			if body, ok := reply.body.(*timestampBody); ok {
+				setRemoteTimes(result, body)
+			}
+			result.Duplicate = p.recv.duplicate(e)
+
+			return result, checkRTT(result.RTT, p.timeout)
+		case <-timer.C:
+			return nil, ErrTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-p.stop:
+			return nil, ErrClosed
+		}
 	}
 }
 
 func (p *icmpPinger) Close() error {
-	p.stop <- true
-	return p.conn.Close()
+	if err := closeOnce(p.once, p.stop); err != nil {
+		return err
+	}
+	if p.conn6 != nil {
+		p.conn6.Close()
+	}
+	return p.conn4.Close()
 }
@@ -0,0 +1,365 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type packet struct {
+	b    []byte
+	addr net.Addr
+}
+
+// fakePacketConn is an ICMPv4 endpoint that answers echo requests
+// after a delay, except for those sent to blackholed destinations.
+// Timestamp requests are answered twice, first as if by a late reply to
+// an earlier request with the same sequence number.
+type fakePacketConn struct {
+	delay     time.Duration
+	blackhole net.IP
+
+	mu       sync.Mutex
+	deadline time.Time
+	in       chan packet
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newFakePacketConn(delay time.Duration, blackhole net.IP) *fakePacketConn {
+	return &fakePacketConn{
+		delay:     delay,
+		blackhole: blackhole,
+		in:        make(chan packet, 1024),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (c *fakePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p := <-c.in:
+		return copy(b, p.b), p.addr, nil
+	case <-timeout:
+		return 0, nil, &net.OpError{Op: "read", Net: "ip4:icmp", Err: timeoutError{}}
+	case <-c.closed:
+		return 0, nil, errors.New("use of closed network connection")
+	}
+}
+
+func (c *fakePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if addr.(*net.IPAddr).IP.Equal(c.blackhole) {
+		return len(b), nil
+	}
+
+	msg, err := icmp.ParseMessage(protocolICMP, b)
+	if err != nil {
+		return 0, err
+	}
+
+	// Replies are made once the delay is over, so that timestamp
+	// replies carry the time they were sent.
+	replies := func() [][]byte {
+		if msg.Type != ipv4.ICMPTypeTimestamp {
+			msg.Type = ipv4.ICMPTypeEchoReply
+			reply, _ := msg.Marshal(nil)
+			return [][]byte{reply}
+		}
+
+		req, _ := parseTimestampBody(msg.Body)
+		now := msSinceMidnight(time.Now())
+		var replies [][]byte
+		for _, originate := range []uint32{req.Originate - 1000, req.Originate} {
+			reply, _ := (&icmp.Message{
+				Type: ipv4.ICMPTypeTimestampReply,
+				Body: &timestampBody{req.ID, req.Seq, originate, now, now},
+			}).Marshal(nil)
+			replies = append(replies, reply)
+		}
+		return replies
+	}
+
+	time.AfterFunc(c.delay, func() {
+		for _, reply := range replies() {
+			select {
+			case c.in <- packet{reply, addr}:
+			case <-c.closed:
+			}
+		}
+	})
+
+	return len(b), nil
+}
+
+func (c *fakePacketConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakePacketConn) LocalAddr() net.Addr {
+	return &net.IPAddr{IP: net.IPv4zero}
+}
+
+func (c *fakePacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *fakePacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *fakePacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func TestICMPConcurrentPings(t *testing.T) {
+	delay := 50 * time.Millisecond
+	blackhole := net.IPv4(192, 0, 2, 1)
+
+	cfg := newConfig([]Option{WithTimeout(time.Second)})
+	p := newICMPPinger(cfg, 1, false, newFakePacketConn(delay, blackhole), nil)
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	// A dead host must not stall probing of the others.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := p.Ping(&net.IPAddr{IP: blackhole}); err == nil {
+			t.Error("expected blackholed ping to time out")
+		}
+	}()
+
+	for i := 0; i < 500; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dst := &net.IPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i))}
+			if _, err := p.Ping(dst); err != nil {
+				t.Errorf("ping %s: %s", dst, err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("pings were serialized: took %s", elapsed)
+	}
+}
+
+func TestICMPPingContext(t *testing.T) {
+	blackhole := net.IPv4(192, 0, 2, 1)
+	cfg := newConfig([]Option{WithTimeout(time.Minute)})
+	p := newICMPPinger(cfg, 1, false, newFakePacketConn(0, blackhole), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.PingContext(ctx, &net.IPAddr{IP: blackhole}); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	errc := make(chan error)
+	go func() {
+		_, err := p.Ping(&net.IPAddr{IP: blackhole})
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Close()
+
+	if err := <-errc; err != ErrClosed {
+		t.Errorf("unexpected error: got %v, want %v", err, ErrClosed)
+	}
+	if _, err := p.Ping(&net.IPAddr{IP: blackhole}); err != ErrClosed {
+		t.Errorf("unexpected error: got %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestParseMessageICMPError(t *testing.T) {
+	req, _ := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: 1, Seq: 2, Data: make([]byte, 8)},
+	}).Marshal(nil)
+	hdr, _ := (&ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(req),
+		TTL:      1,
+		Protocol: protocolICMP,
+		Src:      net.IPv4(192, 0, 2, 2),
+		Dst:      net.IPv4(198, 51, 100, 1),
+	}).Marshal()
+	b, _ := (&icmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable,
+		Code: 1,
+		Body: &icmp.DstUnreach{Data: append(hdr, req...)},
+	}).Marshal(nil)
+
+	router := &net.IPAddr{IP: net.IPv4(192, 0, 2, 254)}
+	msg := parseMessage(protocolICMP, b, router, time.Now())
+	if msg.id != 1 || msg.seq != 2 {
+		t.Errorf("unexpected id and seq: got %d/%d, want 1/2", msg.id, msg.seq)
+	}
+	if !errors.Is(msg.err, ErrDestinationUnreachable) {
+		t.Errorf("unexpected error: got %v, want %v", msg.err, ErrDestinationUnreachable)
+	}
+
+	var icmpErr *ICMPError
+	if !errors.As(msg.err, &icmpErr) {
+		t.Fatalf("unexpected error type: %T", msg.err)
+	}
+	if icmpErr.Reason() != "host_unreachable" {
+		t.Errorf("unexpected reason: got %s, want host_unreachable", icmpErr.Reason())
+	}
+	if icmpErr.From != router || !icmpErr.Dst.Equal(net.IPv4(198, 51, 100, 1)) {
+		t.Errorf("unexpected addresses: from %s, dst %s", icmpErr.From, icmpErr.Dst)
+	}
+
+	// The same bytes carried by a UDP datagram are not an echo request.
+	hdr[9] = byte(layers.IPProtocolUDP)
+	b, _ = (&icmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable,
+		Code: 1,
+		Body: &icmp.DstUnreach{Data: append(hdr, req...)},
+	}).Marshal(nil)
+	if msg := parseMessage(protocolICMP, b, router, time.Now()); msg.err != nil {
+		t.Errorf("unexpected error for a udp datagram: %v", msg.err)
+	}
+}
+
+func TestSetFlow(t *testing.T) {
+	checksum := func(seq, flow int) []byte {
+		data := make([]byte, 56)
+		data[0] = byte(seq * 7)
+		b, _ := (&icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: 1, Seq: seq, Data: data},
+		}).Marshal(nil)
+		setFlow(b, false, flow)
+
+		// The checksum must still be valid.
+		msg, _ := (&icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: 1, Seq: seq, Data: b[8:]},
+		}).Marshal(nil)
+		if string(msg[2:4]) != string(b[2:4]) {
+			t.Errorf("invalid checksum: got %x, want %x", b[2:4], msg[2:4])
+		}
+
+		return b[2:4]
+	}
+
+	if a, b := checksum(1, 3), checksum(2, 3); string(a) != string(b) {
+		t.Errorf("checksums differ within a flow: %x, %x", a, b)
+	}
+	if a, b := checksum(1, 3), checksum(1, 4); string(a) == string(b) {
+		t.Errorf("checksums are the same across flows: %x", a)
+	}
+}
+
+func TestParseMessageFragmentationNeeded(t *testing.T) {
+	req, _ := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: 1, Seq: 2, Data: make([]byte, 1472)},
+	}).Marshal(nil)
+	hdr, _ := (&ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(req),
+		TTL:      63,
+		Protocol: protocolICMP,
+		Src:      net.IPv4(192, 0, 2, 2),
+		Dst:      net.IPv4(198, 51, 100, 1),
+	}).Marshal()
+	b, _ := (&icmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable,
+		Code: 4,
+		Body: &icmp.DstUnreach{Data: append(hdr, req[:8]...)},
+	}).Marshal(nil)
+	// Next-hop MTU, which x/net/icmp does not know about.
+	b[6], b[7] = 0x05, 0x14
+
+	msg := parseMessage(protocolICMP, b, &net.IPAddr{IP: net.IPv4(192, 0, 2, 254)}, time.Now())
+	if !errors.Is(msg.err, ErrPacketTooBig) || !errors.Is(msg.err, ErrDestinationUnreachable) {
+		t.Errorf("unexpected error: %v", msg.err)
+	}
+	if mtu := msg.err.(*ICMPError).MTU; mtu != 1300 {
+		t.Errorf("unexpected mtu: got %d, want 1300", mtu)
+	}
+}
+
+func TestParseMessageExtensions(t *testing.T) {
+	req, _ := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: 1, Seq: 2, Data: make([]byte, 56)},
+	}).Marshal(nil)
+	hdr, _ := (&ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(req),
+		TTL:      1,
+		Protocol: protocolICMP,
+		Src:      net.IPv4(192, 0, 2, 2),
+		Dst:      net.IPv4(198, 51, 100, 1),
+	}).Marshal()
+	labels := []icmp.MPLSLabel{{Label: 16004, TTL: 1}, {Label: 3, S: true, TTL: 1}}
+	b, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &icmp.TimeExceeded{
+			Data: append(hdr, req...),
+			Extensions: []icmp.Extension{
+				&icmp.MPLSLabelStack{Class: 1, Type: 1, Labels: labels},
+				&icmp.InterfaceInfo{
+					Class: 2,
+					Type:  0x04, // Incoming interface, with its IP address
+					Addr:  &net.IPAddr{IP: net.IPv4(203, 0, 113, 1)},
+				},
+			},
+		},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := parseMessage(protocolICMP, b, &net.IPAddr{IP: net.IPv4(192, 0, 2, 254)}, time.Now())
+	if msg.id != 1 || msg.seq != 2 {
+		t.Errorf("unexpected id and seq: got %d/%d, want 1/2", msg.id, msg.seq)
+	}
+	icmpErr, ok := msg.err.(*ICMPError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", msg.err)
+	}
+	if got := icmpErr.MPLSLabels(); len(got) != 2 || got[0] != labels[0] || got[1] != labels[1] {
+		t.Errorf("unexpected labels: got %+v, want %+v", got, labels)
+	}
+	if ifis := icmpErr.Interfaces(); len(ifis) != 1 || !ifis[0].Addr.IP.Equal(net.IPv4(203, 0, 113, 1)) {
+		t.Errorf("unexpected interfaces: %+v", ifis)
+	}
+}
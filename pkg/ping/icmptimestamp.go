@@ -0,0 +1,121 @@
+package ping
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// NewICMPTimestamp returns a Pinger that sends ICMP timestamp requests,
+// which are answered by many routers and other devices with the times
+// they received and replied to the request. It only supports IPv4, as
+// there is no ICMPv6 counterpart, and always uses raw sockets.
+//
+// The timestamps of the device are reported in the result, from which
+// one-way delays can be derived. They only have a resolution of a
+// millisecond, and while the device claims they are in UT, its clock is
+// only considered synchronized if the local one is. Devices which reply
+// with non-standard timestamps, as allowed by RFC 792, are treated as if
+// they had no clock.
+func NewICMPTimestamp(opts ...Option) (Pinger, error) {
+	cfg := newConfig(opts)
+
+	conn, err := listenICMP(false, false, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	p := newICMPPinger(cfg, r.Int63(), false, conn, nil)
+	p.timestamp = true
+
+	return p, nil
+}
+
+// A timestampBody is the body of ICMP timestamp and timestamp reply
+// messages. The timestamps are in milliseconds since midnight UT, unless
+// the most significant bit is set.
+type timestampBody struct {
+	ID        int
+	Seq       int
+	Originate uint32 // When the request was sent
+	Receive   uint32 // When the request was received
+	Transmit  uint32 // When the reply was sent
+}
+
+// Len implements the Len method of icmp.MessageBody.
+func (b *timestampBody) Len(proto int) int {
+	return 16
+}
+
+// Marshal implements the Marshal method of icmp.MessageBody.
+func (b *timestampBody) Marshal(proto int) ([]byte, error) {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint16(buf[0:2], uint16(b.ID))
+	binary.BigEndian.PutUint16(buf[2:4], uint16(b.Seq))
+	binary.BigEndian.PutUint32(buf[4:8], b.Originate)
+	binary.BigEndian.PutUint32(buf[8:12], b.Receive)
+	binary.BigEndian.PutUint32(buf[12:16], b.Transmit)
+	return buf, nil
+}
+
+// parseTimestampBody parses the body of a timestamp reply, which the
+// icmp package does not know about.
+func parseTimestampBody(body icmp.MessageBody) (*timestampBody, error) {
+	raw, ok := body.(*icmp.DefaultMessageBody)
+	if !ok || len(raw.Data) < 16 {
+		return nil, errors.New("timestamp reply too short")
+	}
+
+	b := raw.Data
+	return &timestampBody{
+		ID:        int(binary.BigEndian.Uint16(b[0:2])),
+		Seq:       int(binary.BigEndian.Uint16(b[2:4])),
+		Originate: binary.BigEndian.Uint32(b[4:8]),
+		Receive:   binary.BigEndian.Uint32(b[8:12]),
+		Transmit:  binary.BigEndian.Uint32(b[12:16]),
+	}, nil
+}
+
+const day = 24 * time.Hour
+
+// msSinceMidnight returns t as an ICMP timestamp.
+func msSinceMidnight(t time.Time) uint32 {
+	t = t.UTC()
+	return uint32(t.Sub(t.Truncate(day)) / time.Millisecond)
+}
+
+// timeFromMs returns the time of the ICMP timestamp ms, taking the
+// midnight closest to ref as the reference. It returns false for
+// non-standard timestamps.
+func timeFromMs(ms uint32, ref time.Time) (time.Time, bool) {
+	if ms >= uint32(day/time.Millisecond) {
+		return time.Time{}, false
+	}
+
+	t := ref.UTC().Truncate(day).Add(time.Duration(ms) * time.Millisecond)
+	switch {
+	case t.Sub(ref) > day/2:
+		t = t.Add(-day)
+	case ref.Sub(t) > day/2:
+		t = t.Add(day)
+	}
+
+	return t, true
+}
+
+// setRemoteTimes fills in the timestamps of the device in result, which
+// must already hold the send time.
+func setRemoteTimes(result *Result, reply *timestampBody) {
+	received, ok1 := timeFromMs(reply.Receive, result.Sent)
+	sent, ok2 := timeFromMs(reply.Transmit, result.Sent)
+	if !ok1 || !ok2 {
+		return
+	}
+
+	result.RemoteReceived, result.RemoteSent = received, sent
+	result.Synchronized, _ = clockStatus()
+}
@@ -0,0 +1,105 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestTimeFromMs(t *testing.T) {
+	ref := time.Date(2020, 1, 2, 0, 0, 0, 500e6, time.UTC)
+	for _, tt := range []struct {
+		ms   uint32
+		want time.Time
+	}{
+		{msSinceMidnight(ref), ref.Truncate(time.Millisecond)},
+		// Clocks on either side of midnight.
+		{86399999, time.Date(2020, 1, 1, 23, 59, 59, 999e6, time.UTC)},
+		{1000, time.Date(2020, 1, 2, 0, 0, 1, 0, time.UTC)},
+	} {
+		got, ok := timeFromMs(tt.ms, ref)
+		if !ok || !got.Equal(tt.want) {
+			t.Errorf("timeFromMs(%d): got %s, want %s", tt.ms, got, tt.want)
+		}
+	}
+
+	if _, ok := timeFromMs(1<<31|1000, ref); ok {
+		t.Error("non-standard timestamp accepted")
+	}
+}
+
+func TestParseMessageTimestampReply(t *testing.T) {
+	b, _ := (&icmp.Message{
+		Type: ipv4.ICMPTypeTimestampReply,
+		Body: &timestampBody{ID: 1, Seq: 2, Originate: 3, Receive: 4, Transmit: 5},
+	}).Marshal(nil)
+
+	msg := parseMessage(protocolICMP, b, &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, time.Now())
+	if msg.err != nil {
+		t.Fatal(msg.err)
+	}
+	if msg.id != 1 || msg.seq != 2 {
+		t.Errorf("unexpected id and seq: got %d/%d, want 1/2", msg.id, msg.seq)
+	}
+	if body, ok := msg.body.(*timestampBody); !ok || *body != (timestampBody{1, 2, 3, 4, 5}) {
+		t.Errorf("unexpected body: %+v", msg.body)
+	}
+}
+
+func TestICMPTimestampProbe(t *testing.T) {
+	cfg := newConfig([]Option{WithTimeout(time.Second)})
+	p := newICMPPinger(cfg, 1, false, newFakePacketConn(10*time.Millisecond, nil), nil)
+	p.timestamp = true
+	defer p.Close()
+
+	// The first reply carries the originate timestamp of another
+	// request, so it must be skipped.
+	result, err := p.Probe(context.Background(), &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Duplicate {
+		t.Error("stale reply not detected")
+	}
+
+	forward, reverse, ok := result.OneWayDelays()
+	if !ok {
+		t.Fatal("remote timestamps missing")
+	}
+	// The timestamps of the device only have a resolution of a
+	// millisecond.
+	if forward < 9*time.Millisecond || forward > 500*time.Millisecond || reverse < -time.Millisecond || reverse > 500*time.Millisecond {
+		t.Errorf("unexpected one-way delays: forward %s, reverse %s", forward, reverse)
+	}
+}
+
+func TestSetRemoteTimesMidnight(t *testing.T) {
+	result := &Result{
+		Sent:     time.Date(2020, 1, 1, 23, 59, 59, 990e6, time.UTC),
+		Received: time.Date(2020, 1, 2, 0, 0, 0, 10e6, time.UTC),
+	}
+	setRemoteTimes(result, &timestampBody{Receive: 86399995, Transmit: 2})
+
+	if want := time.Date(2020, 1, 1, 23, 59, 59, 995e6, time.UTC); !result.RemoteReceived.Equal(want) {
+		t.Errorf("unexpected remote receive time: got %s, want %s", result.RemoteReceived, want)
+	}
+	if want := time.Date(2020, 1, 2, 0, 0, 0, 2e6, time.UTC); !result.RemoteSent.Equal(want) {
+		t.Errorf("unexpected remote send time: got %s, want %s", result.RemoteSent, want)
+	}
+
+	forward, reverse, ok := result.OneWayDelays()
+	if !ok || forward != 5*time.Millisecond || reverse != 8*time.Millisecond {
+		t.Errorf("unexpected one-way delays: forward %s, reverse %s", forward, reverse)
+	}
+
+	// Devices without a clock in UT leave the remote times unset.
+	result = &Result{Sent: result.Sent, Received: result.Received}
+	setRemoteTimes(result, &timestampBody{Receive: 1<<31 | 5, Transmit: 1<<31 | 6})
+	if _, _, ok := result.OneWayDelays(); ok {
+		t.Error("non-standard timestamps used")
+	}
+}
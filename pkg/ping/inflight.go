@@ -0,0 +1,121 @@
+package ping
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// An inflight probe is waiting for its reply.
+type inflight struct {
+	sent time.Time // Send time, on the monotonic clock
+	src  net.IP    // Source address, if chosen by the pinger
+	ch   chan interface{}
+	dup  bool
+}
+
+// An inflightSet holds the probes waiting for their replies, keyed by
+// whatever the replies are matched with, such as sequence numbers. It is
+// only locked while registering probes and handing replies to them, so
+// that many probes can be in flight at the same time.
+type inflightSet struct {
+	mu     *sync.Mutex
+	probes map[interface{}]*inflight
+}
+
+func newInflightSet() *inflightSet {
+	return &inflightSet{
+		mu:     new(sync.Mutex),
+		probes: make(map[interface{}]*inflight),
+	}
+}
+
+// add registers e under key until it is removed. It fails if another
+// probe is registered under the same key.
+func (s *inflightSet) add(key interface{}, e *inflight) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.probes[key]; ok {
+		return errors.New("too many probes in flight")
+	}
+	e.ch = make(chan interface{}, 1)
+	s.probes[key] = e
+	return nil
+}
+
+// remove unregisters the probe under key.
+func (s *inflightSet) remove(key interface{}) {
+	s.mu.Lock()
+	delete(s.probes, key)
+	s.mu.Unlock()
+}
+
+// deliver hands reply to the probe registered under key, and returns the
+// probe, or nil if there is none. It never blocks: if the probe already
+// has a reply waiting, the new one is dropped and the probe is marked as
+// having seen duplicates.
+func (s *inflightSet) deliver(key, reply interface{}) *inflight {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.probes[key]
+	if !ok {
+		return nil
+	}
+	select {
+	case e.ch <- reply:
+	default:
+		e.dup = true
+	}
+	return e
+}
+
+// markDup marks e as having seen duplicate or stale replies.
+func (s *inflightSet) markDup(e *inflight) {
+	s.mu.Lock()
+	e.dup = true
+	s.mu.Unlock()
+}
+
+// duplicate reports whether e has seen duplicate or stale replies.
+func (s *inflightSet) duplicate(e *inflight) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return e.dup
+}
+
+// readPackets reads packets from conn with read and passes them to handle
+// until stop is closed. The read deadline is extended by timeout at a
+// time, so that closing stop is noticed even if nothing arrives.
+func readPackets(conn net.PacketConn, read packetReader, timeout time.Duration, stop chan bool, handle func(b []byte, cm *controlMessage, from net.Addr)) {
+	buf := make([]byte, 65536)
+	for {
+		select {
+		default:
+			conn.SetReadDeadline(time.Now().Add(timeout))
+
+			n, cm, from, err := read(buf)
+			if err != nil {
+				// Ignore read timeout errors
+				if neterr, ok := err.(*net.OpError); ok {
+					if neterr.Timeout() {
+						continue
+					}
+				}
+
+				select {
+				case <-stop:
+					return
+				default:
+					log.Println(err)
+					continue
+				}
+			}
+
+			handle(buf[:n], cm, from)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -1,11 +1,413 @@
 package ping
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"net/http"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ErrClosed is returned by in-flight and subsequent pings once the
+// Pinger has been closed.
+var ErrClosed = errors.New("pinger closed")
+
+// A TimestampSource tells where a timestamp was taken.
+type TimestampSource int
+
+const (
+	// TimestampUser is taken in userspace once the syscall returned.
+	TimestampUser TimestampSource = iota
+
+	// TimestampKernel is taken by the kernel network stack.
+	TimestampKernel
+
+	// TimestampHardware is taken by the network interface. Its clock
+	// may not be the system clock, so only the RTT is derived from
+	// hardware timestamps, and send times are converted to the system
+	// clock using it.
+	TimestampHardware
 )
 
+func (s TimestampSource) String() string {
+	switch s {
+	case TimestampUser:
+		return "user"
+	case TimestampKernel:
+		return "kernel"
+	case TimestampHardware:
+		return "hardware"
+	default:
+		return "unknown"
+	}
+}
+
+// A Result describes the outcome of a single probe.
+type Result struct {
+	Seq            int             // Sequence number of the probe
+	Addr           net.Addr        // Address that answered the probe
+	Local          net.IP          // Local address the reply was received on
+	TTL            int             // TTL or hop limit of the reply, -1 if unknown
+	Size           int             // Size of the reply, excluding the IP header
+	Sent           time.Time       // When the probe was sent
+	SentSource     TimestampSource // Where the send time was taken
+	Received       time.Time       // When the reply was received
+	ReceivedSource TimestampSource // Where the receive time was taken
+	RTT            time.Duration   // Round-trip time
+	Duplicate      bool            // Whether duplicate or stale replies were seen
+
+	// Timestamps taken by a reflector, only known for STAMP probes.
+	RemoteReceived time.Time // When the reflector received the probe
+	RemoteSent     time.Time // When the reflector sent the reply
+	Synchronized   bool      // Whether both clocks are believed to be synchronized
+
+	// Details of HTTP probes.
+	StatusCode int          // HTTP status code of the response
+	HTTP       *HTTPTimings // Breakdown of the time taken by the request
+
+	// Details of TLS probes.
+	TLS *TLSInfo // Timings and parameters of the TLS session
+}
+
+// OneWayDelays returns the forward and reverse one-way delays of the
+// probe, if the timestamps of the reflector are known. They are only
+// meaningful if the clocks are synchronized.
+func (r *Result) OneWayDelays() (forward, reverse time.Duration, ok bool) {
+	if r.RemoteReceived.IsZero() || r.RemoteSent.IsZero() {
+		return 0, 0, false
+	}
+	return r.RemoteReceived.Sub(r.Sent), r.Received.Sub(r.RemoteSent), true
+}
+
+// ClockOffset estimates the offset of the clock of the reflector relative
+// to the local one as NTP does, assuming symmetric one-way delays.
+func (r *Result) ClockOffset() (time.Duration, bool) {
+	forward, reverse, ok := r.OneWayDelays()
+	if !ok {
+		return 0, false
+	}
+	return (forward - reverse) / 2, true
+}
+
 type Pinger interface {
+	// Ping sends a probe to the destination and waits for the reply
+	// until the timeout of the pinger expires.
 	Ping(net.Addr) (time.Duration, error)
+
+	// PingContext is like Ping, but also gives up waiting once the
+	// context is done, in which case the context's error is returned.
+	PingContext(context.Context, net.Addr) (time.Duration, error)
+
+	// Probe is like PingContext, but returns everything known about
+	// the reply. The result may be non-nil even if the error is not,
+	// e.g. when the probe was answered with an ICMP error.
+	Probe(context.Context, net.Addr) (*Result, error)
+
+	// Close closes the pinger and unblocks in-flight pings with
+	// ErrClosed. Closing it again returns ErrClosed.
 	Close() error
 }
+
+// A SocketType selects the kind of socket used to send ICMP messages.
+type SocketType int
+
+const (
+	// SocketAuto uses raw sockets when permitted and falls back to
+	// datagram-oriented sockets otherwise.
+	SocketAuto SocketType = iota
+
+	// SocketRaw uses raw sockets, which requires CAP_NET_RAW.
+	SocketRaw
+
+	// SocketDatagram uses unprivileged datagram-oriented ICMP sockets.
+	// On Linux, the group of the process must be allowed by the
+	// net.ipv4.ping_group_range sysctl.
+	SocketDatagram
+)
+
+// checkRTT returns ErrImplausibleRTT if rtt could not have been measured
+// by a probe with the given timeout.
+func checkRTT(rtt, timeout time.Duration) error {
+	if rtt < 0 || rtt > timeout {
+		return ErrImplausibleRTT
+	}
+	return nil
+}
+
+// dialError translates err, returned while probing with a connection
+// set up by a net.Dialer, into the error returned by Probe. The probe
+// is bound by reqCtx, which is derived from ctx, until stop is closed.
+func dialError(stop chan bool, ctx, reqCtx context.Context, err error) error {
+	select {
+	case <-stop:
+		return ErrClosed
+	default:
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if reqCtx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		return ErrTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrPortClosed
+	}
+	return err
+}
+
+// closeOnce closes stop the first time it is called with once, and
+// returns ErrClosed afterwards, so that pingers can be closed repeatedly.
+func closeOnce(once *sync.Once, stop chan bool) error {
+	err := ErrClosed
+	once.Do(func() {
+		close(stop)
+		err = nil
+	})
+	return err
+}
+
+// rtt adapts the return values of Probe to those of Ping.
+func rtt(r *Result, err error) (time.Duration, error) {
+	if r == nil {
+		return 0, err
+	}
+	return r.RTT, err
+}
+
+// newPayload returns a payload of the configured size, filled with the
+// configured pattern after the first 8 bytes, which are reserved for the
+// send timestamp.
+func newPayload(cfg *config) []byte {
+	payload := make([]byte, cfg.payloadSize)
+	if len(cfg.pattern) > 0 {
+		for i := 8; i < len(payload); i += len(cfg.pattern) {
+			copy(payload[i:], cfg.pattern)
+		}
+	}
+	return payload
+}
+
+type config struct {
+	timeout     time.Duration
+	payloadSize int
+	pattern     []byte
+	ttl         int
+	tos         int
+	df          bool
+	src         net.IP
+	iface       string
+	hwTimestamp bool
+	socketType  SocketType
+	srcPorts    [2]uint16
+	reset       bool
+	echo        bool
+	method      string
+	tls         *tls.Config
+	query       string
+	qtype       layers.DNSType
+	maxHops     int
+	maxFlows    int
+	mtuMin      int
+	mtuMax      int
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		timeout:     5 * time.Second,
+		payloadSize: 56,
+		socketType:  SocketAuto,
+		srcPorts:    [2]uint16{23333, 23333},
+		reset:       true,
+		method:      http.MethodGet,
+		maxHops:     30,
+		maxFlows:    16,
+		mtuMin:      1280,
+		mtuMax:      1500,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// An Option configures a Pinger.
+type Option func(*config)
+
+// WithTimeout sets how long to wait for a reply. The default is 5
+// seconds.
+func WithTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.timeout = d
+	}
+}
+
+// WithPayloadSize sets the size of the ICMP echo or UDP payload in bytes,
+// or of STAMP test packets. The first 8 bytes carry the send timestamp,
+// so smaller sizes are rounded up. The default is 56 bytes. It does not
+// apply to the TCP pinger.
+func WithPayloadSize(n int) Option {
+	return func(c *config) {
+		if n < 8 {
+			n = 8
+		}
+		c.payloadSize = n
+	}
+}
+
+// WithPattern sets the bytes repeated to fill the ICMP echo or UDP
+// payload after the timestamp. By default, the payload is zero-filled.
+// It does not apply to the TCP pinger.
+func WithPattern(pattern []byte) Option {
+	return func(c *config) {
+		c.pattern = pattern
+	}
+}
+
+// WithTTL sets the TTL, or hop limit for IPv6, of outgoing packets.
+func WithTTL(ttl int) Option {
+	return func(c *config) {
+		c.ttl = ttl
+	}
+}
+
+// WithTOS sets the TOS field, or traffic class for IPv6, of outgoing
+// packets. The DSCP occupies its upper 6 bits, e.g. EF is 46<<2.
+func WithTOS(tos int) Option {
+	return func(c *config) {
+		c.tos = tos
+	}
+}
+
+// WithDontFragment sets the DF bit on outgoing packets, or disables
+// fragmentation for IPv6.
+func WithDontFragment(enabled bool) Option {
+	return func(c *config) {
+		c.df = enabled
+	}
+}
+
+// WithSource sets the source address of outgoing packets. It only
+// applies to destinations of the same address family.
+func WithSource(ip net.IP) Option {
+	return func(c *config) {
+		c.src = ip
+	}
+}
+
+// WithInterface restricts the pinger to the named network interface.
+func WithInterface(name string) Option {
+	return func(c *config) {
+		c.iface = name
+	}
+}
+
+// WithHardwareTimestamps requests hardware receive timestamps from the
+// network interface in addition to kernel software timestamps. It only
+// takes effect if hardware timestamping is enabled on the interface,
+// e.g. with hwstamp_ctl, otherwise software timestamps are used.
+func WithHardwareTimestamps(enabled bool) Option {
+	return func(c *config) {
+		c.hwTimestamp = enabled
+	}
+}
+
+// WithSocketType sets the kind of socket used by the ICMP pinger.
+func WithSocketType(t SocketType) Option {
+	return func(c *config) {
+		c.socketType = t
+	}
+}
+
+// WithSourcePorts sets the range of source ports the TCP pinger rotates
+// through, so that consecutive probes use different flows. By default,
+// all probes are sent from port 23333. The range must not overlap the
+// ephemeral ports of the kernel, set by net.ipv4.ip_local_port_range on
+// Linux, otherwise NewTCP fails.
+func WithSourcePorts(first, last uint16) Option {
+	return func(c *config) {
+		if first > last {
+			first, last = last, first
+		}
+		c.srcPorts = [2]uint16{first, last}
+	}
+}
+
+// WithReset sets whether the TCP pinger sends a RST after receiving a
+// SYN-ACK. It is enabled by default, so that targets are not left with
+// half-open connections. For the TCP connect pinger, it sets whether
+// connections are reset instead of closed normally.
+func WithReset(enabled bool) Option {
+	return func(c *config) {
+		c.reset = enabled
+	}
+}
+
+// WithEcho sets whether the UDP pinger expects a UDP reply from an echo
+// service such as RFC 862 running on the destination port. By default,
+// the destination port is expected to be closed and probes are answered
+// with ICMP port unreachable errors.
+func WithEcho(enabled bool) Option {
+	return func(c *config) {
+		c.echo = enabled
+	}
+}
+
+// WithMethod sets the method of the requests sent by the HTTP pinger,
+// such as GET, which is the default, or HEAD.
+func WithMethod(method string) Option {
+	return func(c *config) {
+		c.method = method
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used to connect to HTTPS
+// endpoints. By default, the system roots are trusted.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(c *config) {
+		c.tls = tlsConfig
+	}
+}
+
+// WithQuery sets the name and type of the queries sent by the DNS
+// pinger, such as "example.com" and layers.DNSTypeA. The root is ".".
+func WithQuery(name string, qtype layers.DNSType) Option {
+	return func(c *config) {
+		c.query = name
+		c.qtype = qtype
+	}
+}
+
+// WithMaxHops sets the largest TTL or hop limit probed by the Tracer.
+// The default is 30.
+func WithMaxHops(n int) Option {
+	return func(c *config) {
+		c.maxHops = n
+	}
+}
+
+// WithMaxFlows sets the maximum number of flows traced by the Tracer to
+// enumerate the paths to a destination. The default is 16.
+func WithMaxFlows(n int) Option {
+	return func(c *config) {
+		c.maxFlows = n
+	}
+}
+
+// WithMTURange sets the bounds of the path MTU discovered by the
+// MTUProber, in bytes including the IP header. The default is 1280 to
+// 1500.
+func WithMTURange(min, max int) Option {
+	return func(c *config) {
+		c.mtuMin = min
+		c.mtuMax = max
+	}
+}
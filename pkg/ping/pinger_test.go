@@ -0,0 +1,34 @@
+package ping
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestCloseTwice(t *testing.T) {
+	constructors := map[string]func(...Option) (Pinger, error){
+		"icmp": func(opts ...Option) (Pinger, error) {
+			return newICMPPinger(newConfig(opts), 1, false, newFakePacketConn(0, nil), nil), nil
+		},
+		"udp":        NewUDP,
+		"dns":        NewDNS,
+		"http":       NewHTTP,
+		"tls":        NewTLS,
+		"tcpconnect": NewTCPConnect,
+	}
+
+	for name, newPinger := range constructors {
+		p, err := newPinger(WithQuery("example.com.", layers.DNSTypeA))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if err := p.Close(); err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		if err := p.Close(); err != ErrClosed {
+			t.Errorf("%s: unexpected error: got %v, want %v", name, err, ErrClosed)
+		}
+	}
+}
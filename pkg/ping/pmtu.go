@@ -0,0 +1,146 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// A PathMTU is the outcome of a path MTU discovery.
+type PathMTU struct {
+	MTU       int  // Size of the largest packets known to reach the destination, including the IP header
+	Reported  int  // Smallest MTU reported by packet too big errors, 0 if there were none
+	BlackHole bool // Whether larger packets were lost without packet too big errors
+}
+
+// pmtuTries is the number of probes of a given size which must be lost
+// before concluding that packets of that size do not get through.
+const pmtuTries = 2
+
+// An MTUProber discovers the path MTU to destinations, by sending ICMP
+// echo requests of varying sizes with the DF bit set.
+type MTUProber struct {
+	pinger *icmpPinger
+	min    int
+	max    int
+}
+
+// NewMTUProber returns an MTUProber, which searches for the path MTU
+// between the bounds set with WithMTURange. It always uses raw sockets,
+// as ICMP errors are not delivered to datagram-oriented ones. The
+// payload size set with WithPayloadSize is ignored.
+func NewMTUProber(opts ...Option) (*MTUProber, error) {
+	cfg := newConfig(opts)
+	if cfg.mtuMin < ipv6.HeaderLen+8+8 || cfg.mtuMax < cfg.mtuMin {
+		return nil, fmt.Errorf("invalid mtu range: %d-%d", cfg.mtuMin, cfg.mtuMax)
+	}
+
+	p, err := NewICMP(append(opts, WithSocketType(SocketRaw))...)
+	if err != nil {
+		return nil, err
+	}
+	pinger := p.(*icmpPinger)
+
+	if err := setProbeMTU(pinger.conn4, false); err != nil {
+		pinger.Close()
+		return nil, err
+	}
+	if pinger.conn6 != nil {
+		if err := setProbeMTU(pinger.conn6, true); err != nil {
+			pinger.Close()
+			return nil, err
+		}
+	}
+
+	return &MTUProber{pinger, cfg.mtuMin, cfg.mtuMax}, nil
+}
+
+// Discover searches for the path MTU to dst. Packets of the lower bound
+// of the range must get through, otherwise an error is returned.
+//
+// The search is a binary one, but takes shortcuts to the MTU reported by
+// packet too big errors. Packets which are lost without such an error
+// are retried once, and are then taken as a sign of a black hole.
+func (m *MTUProber) Discover(ctx context.Context, dst net.Addr) (*PathMTU, error) {
+	dstAddr, ok := dst.(*net.IPAddr)
+	if !ok {
+		return nil, errors.New("dst must be a *net.IPAddr")
+	}
+	overhead := ipv4.HeaderLen + 8
+	if dstAddr.IP.To4() == nil {
+		overhead = ipv6.HeaderLen + 8
+	}
+
+	result := new(PathMTU)
+
+	// fits reports whether packets of the given size get through, and
+	// if not, whether they were lost without a packet too big error.
+	fits := func(size int) (ok, lost bool, err error) {
+		for i := 0; i < pmtuTries; i++ {
+			_, err := m.pinger.probe(ctx, dst, probeOptions{size: size - overhead})
+
+			var icmpErr *ICMPError
+			switch {
+			case err == nil || err == ErrImplausibleRTT:
+				return true, false, nil
+			case errors.As(err, &icmpErr) && errors.Is(err, ErrPacketTooBig):
+				if mtu := icmpErr.MTU; mtu > 0 && (result.Reported == 0 || mtu < result.Reported) {
+					result.Reported = mtu
+				}
+				return false, false, nil
+			case errors.Is(err, syscall.EMSGSIZE):
+				// The packet does not fit the outgoing interface.
+				return false, false, nil
+			case err != ErrTimeout:
+				return false, false, err
+			}
+		}
+		return false, true, nil
+	}
+
+	// Packets of lo bytes get through, and those of hi bytes do not.
+	lo, hi := m.min, m.max+1
+	ok, lost, err := fits(lo)
+	switch {
+	case err != nil:
+		return nil, err
+	case lost:
+		return nil, ErrTimeout
+	case !ok:
+		return nil, fmt.Errorf("path mtu below %d bytes", m.min)
+	}
+
+	// Optimistically try the upper bound first.
+	next := m.max
+	for hi-lo > 1 {
+		ok, lost, err := fits(next)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			lo = next
+		} else {
+			hi = next
+			result.BlackHole = result.BlackHole || lost
+		}
+
+		next = (lo + hi) / 2
+		if mtu := result.Reported; mtu > lo && mtu < hi {
+			next = mtu
+		}
+	}
+	result.MTU = lo
+
+	return result, nil
+}
+
+// Close closes the sockets of the MTUProber. Discoveries in progress
+// return ErrClosed.
+func (m *MTUProber) Close() error {
+	return m.pinger.Close()
+}
@@ -0,0 +1,367 @@
+package ping
+
+import (
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// setSockopts applies the IP level options in cfg to conn.
+func setSockopts(conn net.PacketConn, v6 bool, cfg *config) error {
+	if v6 {
+		p := ipv6.NewPacketConn(conn)
+		if cfg.ttl > 0 {
+			if err := p.SetHopLimit(cfg.ttl); err != nil {
+				return err
+			}
+		}
+		if cfg.tos > 0 {
+			if err := p.SetTrafficClass(cfg.tos); err != nil {
+				return err
+			}
+		}
+	} else {
+		p := ipv4.NewPacketConn(conn)
+		if cfg.ttl > 0 {
+			if err := p.SetTTL(cfg.ttl); err != nil {
+				return err
+			}
+		}
+		if cfg.tos > 0 {
+			if err := p.SetTOS(cfg.tos); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cfg.df {
+		if err := setDontFragment(conn, v6); err != nil {
+			return err
+		}
+	}
+	if cfg.iface != "" {
+		if err := bindToDevice(conn, cfg.iface); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sourceAddr returns the address to bind an endpoint of the given IP
+// version to, honoring the source address in cfg if it is of the same
+// version.
+func sourceAddr(v6 bool, cfg *config) net.IP {
+	if cfg.src != nil && (cfg.src.To4() == nil) == v6 {
+		return cfg.src
+	}
+	if v6 {
+		return net.IPv6unspecified
+	}
+	return net.IPv4zero
+}
+
+// A controlMessage holds the IP level information of a received packet.
+type controlMessage struct {
+	TTL        int             // TTL or hop limit, -1 if unknown
+	Dst        net.IP          // Destination address of the packet
+	Time       time.Time       // When the packet was received
+	TimeSource TimestampSource // Where the receive time was taken
+	HWTime     time.Time       // Hardware receive timestamp, on the clock of the interface
+	Mono       time.Time       // When the packet was read, on the monotonic clock
+}
+
+// A packetReader reads a packet and its control message.
+type packetReader func(b []byte) (int, *controlMessage, net.Addr, error)
+
+// newPacketReader returns a packetReader for conn. For sockets, it
+// enables control messages and reads the kernel receive timestamps
+// enabled by newTimestamper, falling back to userspace time when those
+// are unavailable. Raw IPv4 headers are stripped from the returned
+// packets.
+func newPacketReader(conn net.PacketConn, v6 bool) packetReader {
+	switch conn.(type) {
+	case *net.IPConn, *net.UDPConn:
+	default:
+		return func(b []byte) (int, *controlMessage, net.Addr, error) {
+			n, src, err := conn.ReadFrom(b)
+			now := time.Now()
+			return n, &controlMessage{TTL: -1, Time: now, Mono: now}, src, err
+		}
+	}
+
+	if v6 {
+		ipv6.NewPacketConn(conn).SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagDst, true)
+	} else {
+		ipv4.NewPacketConn(conn).SetControlMessage(ipv4.FlagTTL|ipv4.FlagDst, true)
+	}
+
+	oob := make([]byte, 512)
+	return func(b []byte) (int, *controlMessage, net.Addr, error) {
+		var n, oobn int
+		var src net.Addr
+		var err error
+		switch c := conn.(type) {
+		case *net.IPConn:
+			var addr *net.IPAddr
+			n, oobn, _, addr, err = c.ReadMsgIP(b, oob)
+			if err == nil && !v6 && n > 0 {
+				// Unlike ReadFrom, ReadMsgIP does not strip the
+				// IPv4 header.
+				n = copy(b, b[int(b[0]&0x0f)<<2:n])
+			}
+			src = addr
+		case *net.UDPConn:
+			var addr *net.UDPAddr
+			n, oobn, _, addr, err = c.ReadMsgUDP(b, oob)
+			src = addr
+		}
+		if err != nil {
+			return 0, nil, nil, err
+		}
+
+		now := time.Now()
+		cm := &controlMessage{TTL: -1, Time: now, TimeSource: TimestampUser, Mono: now}
+		if v6 {
+			var cm6 ipv6.ControlMessage
+			if cm6.Parse(oob[:oobn]) == nil && cm6.HopLimit > 0 {
+				cm.TTL, cm.Dst = cm6.HopLimit, cm6.Dst
+			}
+		} else {
+			var cm4 ipv4.ControlMessage
+			if cm4.Parse(oob[:oobn]) == nil && cm4.TTL > 0 {
+				cm.TTL, cm.Dst = cm4.TTL, cm4.Dst
+			}
+		}
+		sw, hw := parseTimestamp(oob[:oobn])
+		if !sw.IsZero() {
+			cm.Time, cm.TimeSource = sw, TimestampKernel
+		}
+		cm.HWTime = hw
+
+		return n, cm, src, nil
+	}
+}
+
+// Origins of the entries of the socket error queue.
+const (
+	originLocal        = 1
+	originICMP         = 2
+	originICMP6        = 3
+	originTimestamping = 4
+)
+
+// A sockError is an entry of the socket error queue, which is either an
+// ICMP error or a transmit timestamp.
+type sockError struct {
+	Origin   uint8
+	Type     uint8
+	Code     uint8
+	Info     uint32    // MTU for fragmentation needed errors
+	Data     uint32    // Packet id for transmit timestamps
+	Offender net.IP    // Address of the node that sent the ICMP error
+	Time     time.Time // Software timestamp
+	HWTime   time.Time // Hardware timestamp, on the clock of the interface
+}
+
+// maxPending is the number of packets sent after which an unclaimed
+// transmit timestamp is discarded.
+const maxPending = 1 << 12
+
+// A timestamper sends packets on a socket and recovers the times they
+// were handed to the network interface, as reported by the kernel on
+// the socket error queue.
+//
+// The kernel numbers the packets sent on a socket consecutively, so
+// sends are serialized to keep track of the id of each packet.
+type timestamper struct {
+	conn net.PacketConn
+	hw   bool
+	tx   bool // Whether transmit timestamps are enabled
+
+	mu   *sync.Mutex // Serializes sends
+	next uint32
+
+	qmu     *sync.Mutex // Guards pending and reads from the error queue
+	pending map[uint32]txTimestamp
+
+	// Called with the entries of the error queue other than transmit
+	// timestamps, if not nil.
+	handleError func(*sockError)
+}
+
+// A txTimestamp holds the transmit timestamps of a packet, which the
+// kernel reports separately.
+type txTimestamp struct {
+	sw time.Time // Software timestamp, on the system clock
+	hw time.Time // Hardware timestamp, on the clock of the interface
+}
+
+// newTimestamper enables kernel timestamps on conn and returns a
+// timestamper for it. If hw is true, hardware timestamps are requested
+// as well.
+func newTimestamper(conn net.PacketConn, hw bool) *timestamper {
+	t := &timestamper{
+		conn:    conn,
+		hw:      hw,
+		mu:      new(sync.Mutex),
+		qmu:     new(sync.Mutex),
+		pending: make(map[uint32]txTimestamp),
+	}
+
+	if _, ok := conn.(syscall.Conn); ok {
+		var err error
+		if t.tx, err = enableTimestamps(conn, hw); err != nil {
+			log.Printf("Kernel timestamps unavailable: %s", err)
+		}
+	}
+
+	return t
+}
+
+// WriteTo writes b to addr and returns the id of the packet, which can
+// be passed to Sent to get its transmit timestamp. If addr is nil, b is
+// written to the peer of the connected conn.
+func (t *timestamper) WriteTo(b []byte, addr net.Addr) (uint32, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var err error
+	if addr == nil {
+		_, err = t.conn.(net.Conn).Write(b)
+	} else {
+		_, err = t.conn.WriteTo(b, addr)
+	}
+	if err != nil {
+		// Whether the kernel counted the failed packet depends on where
+		// it failed, so start over to keep the ids in sync.
+		if t.tx {
+			t.qmu.Lock()
+			t.drain()
+			t.pending = make(map[uint32]txTimestamp)
+			t.qmu.Unlock()
+
+			if err := resetTimestampID(t.conn, t.hw); err != nil {
+				log.Printf("Transmit timestamps disabled: %s", err)
+				t.tx = false
+			}
+			t.next = 0
+		}
+		return 0, err
+	}
+
+	id := t.next
+	t.next++
+	return id, nil
+}
+
+// RoundTrip returns the send time of the packet with the given id, where
+// it was taken, and the round-trip time to its reply received with cm.
+// Sent is the userspace time the packet was written, which must carry a
+// monotonic clock reading.
+//
+// The RTT is only derived from timestamps taken from the same clock.
+// Hardware ones come from the clock of the network interface, so they
+// are only used if both the packet and its reply have one, and the send
+// time is then expressed on the system clock by going back from the
+// receive time. Software timestamps are taken from the wall clock, so
+// the RTT derived from them is only used if it agrees with the monotonic
+// clock, which is immune to clock steps. Otherwise, the monotonic RTT is
+// returned.
+func (t *timestamper) RoundTrip(id uint32, sent time.Time, cm *controlMessage) (time.Time, TimestampSource, time.Duration) {
+	mono := cm.Mono.Sub(sent)
+
+	ts, source, received := sent, TimestampUser, cm.Time
+	if tx, ok := t.Sent(id); ok {
+		switch {
+		case !tx.hw.IsZero() && !cm.HWTime.IsZero():
+			ts, source, received = tx.hw, TimestampHardware, cm.HWTime
+		case !tx.sw.IsZero():
+			ts, source = tx.sw, TimestampKernel
+		}
+	}
+	rtt := received.Sub(ts)
+
+	// The kernel takes its timestamps after the packet was written and
+	// before it was read, so the interval between them can only be
+	// shorter.
+	if rtt < 0 || rtt > mono {
+		return sent, TimestampUser, mono
+	}
+
+	if source == TimestampHardware {
+		ts = cm.Time.Add(-rtt)
+	}
+	return ts, source, rtt
+}
+
+// Sent returns the transmit timestamps of the packet with the given id,
+// if the kernel has reported any by now. Each packet's timestamps can
+// only be retrieved once. Probes must claim them even if no reply
+// arrives, so that the error queue does not fill up the receive buffer.
+func (t *timestamper) Sent(id uint32) (txTimestamp, bool) {
+	t.mu.Lock()
+	tx, next := t.tx, t.next
+	t.mu.Unlock()
+	if !tx {
+		return txTimestamp{}, false
+	}
+
+	t.qmu.Lock()
+	defer t.qmu.Unlock()
+
+	t.drain()
+	for k := range t.pending {
+		if next-k > maxPending {
+			delete(t.pending, k)
+		}
+	}
+
+	ts, ok := t.pending[id]
+	if !ok {
+		return txTimestamp{}, false
+	}
+	delete(t.pending, id)
+
+	return ts, true
+}
+
+// Drain reads the error queue, so that ICMP errors are passed to
+// handleError.
+func (t *timestamper) Drain() {
+	t.qmu.Lock()
+	t.drain()
+	t.qmu.Unlock()
+}
+
+// drain reads the error queue and collects the transmit timestamps on
+// it. The caller must hold qmu.
+func (t *timestamper) drain() {
+	readErrQueue(t.conn, func(e *sockError) {
+		if e.Origin != originTimestamping {
+			if t.handleError != nil {
+				t.handleError(e)
+			}
+			return
+		}
+		if e.Time.IsZero() && e.HWTime.IsZero() {
+			return
+		}
+
+		// Hardware timestamps are reported separately from software
+		// ones, keep both.
+		ts := t.pending[e.Data]
+		if !e.Time.IsZero() {
+			ts.sw = e.Time
+		}
+		if !e.HWTime.IsZero() {
+			ts.hw = e.HWTime
+		}
+		t.pending[e.Data] = ts
+	})
+}
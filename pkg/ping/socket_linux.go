@@ -0,0 +1,321 @@
+package ping
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Flags for SO_TIMESTAMPING, see Documentation/networking/timestamping.txt
+// in the Linux source tree.
+const (
+	sofTimestampingTxHardware  = 1 << 0
+	sofTimestampingTxSoftware  = 1 << 1
+	sofTimestampingRxHardware  = 1 << 2
+	sofTimestampingRxSoftware  = 1 << 3
+	sofTimestampingSoftware    = 1 << 4
+	sofTimestampingRawHardware = 1 << 6
+	sofTimestampingOptID       = 1 << 7
+	sofTimestampingOptTSOnly   = 1 << 11
+)
+
+// control calls fn with the file descriptor underlying conn.
+func control(conn net.PacketConn, fn func(fd int) error) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return syscall.EINVAL
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = fn(int(fd))
+	}); err != nil {
+		return err
+	}
+
+	return serr
+}
+
+// listenDatagram opens a datagram-oriented ICMP endpoint bound to src.
+func listenDatagram(src net.IP) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	var sa syscall.Sockaddr
+	if ip := src.To4(); ip != nil {
+		sa4 := &syscall.SockaddrInet4{}
+		copy(sa4.Addr[:], ip)
+		sa = sa4
+	} else {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], src.To16())
+		sa = sa6
+	}
+
+	s, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.Bind(s, sa); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	f := os.NewFile(uintptr(s), "datagram-oriented icmp")
+	defer f.Close()
+
+	return net.FilePacketConn(f)
+}
+
+// setDontFragment sets the DF bit on all packets sent on conn.
+func setDontFragment(conn net.PacketConn, v6 bool) error {
+	return control(conn, func(fd int) error {
+		if v6 {
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+		}
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	})
+}
+
+// setProbeMTU sets the DF bit on all packets sent on conn, like
+// setDontFragment, but lets them exceed the path MTU known to the kernel,
+// so that the path MTU can be probed.
+func setProbeMTU(conn net.PacketConn, v6 bool) error {
+	return control(conn, func(fd int) error {
+		if v6 {
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+		}
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+	})
+}
+
+// dialControl returns a function for net.Dialer's Control, which applies
+// the IP level options in cfg to sockets before they connect.
+func dialControl(cfg *config) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		v6 := strings.HasSuffix(network, "6")
+
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			s := int(fd)
+			switch {
+			case cfg.ttl > 0 && v6:
+				serr = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, cfg.ttl)
+			case cfg.ttl > 0:
+				serr = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_TTL, cfg.ttl)
+			}
+			switch {
+			case serr != nil || cfg.tos <= 0:
+			case v6:
+				serr = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, cfg.tos)
+			default:
+				serr = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_TOS, cfg.tos)
+			}
+			switch {
+			case serr != nil || !cfg.df:
+			case v6:
+				serr = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+			default:
+				serr = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+			}
+			if serr == nil && cfg.iface != "" {
+				serr = syscall.BindToDevice(s, cfg.iface)
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		return serr
+	}
+}
+
+// bindToDevice restricts conn to the given network interface.
+func bindToDevice(conn net.PacketConn, name string) error {
+	return control(conn, func(fd int) error {
+		return syscall.BindToDevice(fd, name)
+	})
+}
+
+func timestampingFlags(hw bool) int {
+	flags := sofTimestampingRxSoftware | sofTimestampingTxSoftware |
+		sofTimestampingSoftware | sofTimestampingOptID | sofTimestampingOptTSOnly
+	if hw {
+		flags |= sofTimestampingRxHardware | sofTimestampingTxHardware |
+			sofTimestampingRawHardware
+	}
+	return flags
+}
+
+// enableTimestamps enables kernel receive and transmit timestamps on
+// conn. If hw is true, hardware timestamps are requested as well, which
+// the network interface may or may not provide. On kernels without
+// SO_TIMESTAMPING, only receive timestamps are enabled and tx is false.
+func enableTimestamps(conn net.PacketConn, hw bool) (tx bool, err error) {
+	err = control(conn, func(fd int) error {
+		if syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, timestampingFlags(hw)) == nil {
+			tx = true
+			return nil
+		}
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+	})
+	return tx, err
+}
+
+// resetTimestampID restarts the numbering of transmit timestamps on conn
+// from zero.
+func resetTimestampID(conn net.PacketConn, hw bool) error {
+	return control(conn, func(fd int) error {
+		flags := timestampingFlags(hw)
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, flags&^sofTimestampingOptID); err != nil {
+			return err
+		}
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, flags)
+	})
+}
+
+// readErrQueue drains the error queue of conn and calls fn with each
+// entry. It does not block.
+func readErrQueue(conn net.PacketConn, fn func(*sockError)) error {
+	return control(conn, func(fd int) error {
+		oob := make([]byte, 512)
+		for {
+			_, oobn, _, _, err := syscall.Recvmsg(fd, nil, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				return nil
+			}
+			if err != nil {
+				return os.NewSyscallError("recvmsg", err)
+			}
+
+			msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+			if err != nil {
+				continue
+			}
+
+			for _, m := range msgs {
+				if !(m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_RECVERR) &&
+					!(m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == syscall.IPV6_RECVERR) {
+					continue
+				}
+
+				// struct sock_extended_err, followed by the
+				// address of the node that caused the error.
+				b := m.Data
+				if len(b) < 16 {
+					continue
+				}
+				e := &sockError{
+					Origin: b[4],
+					Type:   b[5],
+					Code:   b[6],
+					Info:   *(*uint32)(unsafe.Pointer(&b[8])),
+					Data:   *(*uint32)(unsafe.Pointer(&b[12])),
+				}
+				if len(b) >= 16+8 {
+					switch *(*uint16)(unsafe.Pointer(&b[16])) {
+					case syscall.AF_INET:
+						e.Offender = append(net.IP(nil), b[16+4:16+8]...)
+					case syscall.AF_INET6:
+						if len(b) >= 16+24 {
+							e.Offender = append(net.IP(nil), b[16+8:16+24]...)
+						}
+					}
+				}
+				e.Time, e.HWTime = parseTimestamp(oob[:oobn])
+
+				fn(e)
+			}
+		}
+	})
+}
+
+// setRecvErr enables the extended reporting of ICMP errors to the error
+// queue of conn.
+func setRecvErr(conn net.PacketConn, v6 bool) error {
+	return control(conn, func(fd int) error {
+		if v6 {
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR, 1)
+		}
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVERR, 1)
+	})
+}
+
+func timespec(b []byte) (time.Time, bool) {
+	if len(b) < int(unsafe.Sizeof(syscall.Timespec{})) {
+		return time.Time{}, false
+	}
+	ts := (*syscall.Timespec)(unsafe.Pointer(&b[0]))
+	if ts.Sec == 0 && ts.Nsec == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(ts.Unix()), true
+}
+
+// parseTimestamp returns the software timestamp carried in the control
+// messages oob, and the raw hardware timestamp if there is one. The
+// latter is taken from the clock of the network interface, which is not
+// necessarily related to the system clock.
+func parseTimestamp(oob []byte) (sw, hw time.Time) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, time.Time{}
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_SOCKET {
+			continue
+		}
+
+		switch m.Header.Type {
+		case syscall.SCM_TIMESTAMPNS:
+			sw, _ = timespec(m.Data)
+		case syscall.SCM_TIMESTAMPING:
+			// The payload is an array of three timespecs: the
+			// software timestamp, a deprecated one, and the raw
+			// hardware timestamp.
+			size := int(unsafe.Sizeof(syscall.Timespec{}))
+			sw, _ = timespec(m.Data)
+			if len(m.Data) >= 3*size {
+				hw, _ = timespec(m.Data[2*size:])
+			}
+		}
+	}
+
+	return sw, hw
+}
+
+// localPortRange returns the range of ports the kernel picks ephemeral
+// ports from, which also applies to IPv6.
+func localPortRange() (first, last uint16, ok bool) {
+	b, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+	if err != nil {
+		return 0, 0, false
+	}
+	if _, err := fmt.Sscan(string(b), &first, &last); err != nil {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// clockStatus reports whether the system clock is synchronized, e.g. by
+// NTP, and the estimated error of it, as maintained by the kernel.
+func clockStatus() (bool, time.Duration) {
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return false, 0
+	}
+
+	// TIME_ERROR and STA_UNSYNC, see adjtimex(2).
+	synced := state != 5 && tx.Status&0x40 == 0
+	return synced, time.Duration(tx.Esterror) * time.Microsecond
+}
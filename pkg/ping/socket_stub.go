@@ -0,0 +1,73 @@
+//go:build !linux
+// +build !linux
+
+package ping
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+var errNotSupported = errors.New("not supported on this platform")
+
+// listenDatagram opens a datagram-oriented ICMP endpoint bound to src,
+// as supported by the icmp package on Darwin.
+func listenDatagram(src net.IP) (net.PacketConn, error) {
+	if src.To4() != nil {
+		return icmp.ListenPacket("udp4", src.String())
+	}
+	return icmp.ListenPacket("udp6", src.String())
+}
+
+func setDontFragment(conn net.PacketConn, v6 bool) error {
+	return errNotSupported
+}
+
+func setProbeMTU(conn net.PacketConn, v6 bool) error {
+	return errNotSupported
+}
+
+func bindToDevice(conn net.PacketConn, name string) error {
+	return errNotSupported
+}
+
+func enableTimestamps(conn net.PacketConn, hw bool) (bool, error) {
+	return false, errNotSupported
+}
+
+func resetTimestampID(conn net.PacketConn, hw bool) error {
+	return errNotSupported
+}
+
+func readErrQueue(conn net.PacketConn, fn func(*sockError)) error {
+	return errNotSupported
+}
+
+func setRecvErr(conn net.PacketConn, v6 bool) error {
+	return errNotSupported
+}
+
+func parseTimestamp(oob []byte) (sw, hw time.Time) {
+	return time.Time{}, time.Time{}
+}
+
+func localPortRange() (first, last uint16, ok bool) {
+	return 0, 0, false
+}
+
+func clockStatus() (bool, time.Duration) {
+	return false, 0
+}
+
+func dialControl(cfg *config) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if cfg.ttl > 0 || cfg.tos > 0 || cfg.df || cfg.iface != "" {
+			return errNotSupported
+		}
+		return nil
+	}
+}
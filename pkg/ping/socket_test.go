@@ -0,0 +1,81 @@
+package ping
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoundTripClockStep(t *testing.T) {
+	ts := newTimestamper(newFakePacketConn(0, nil), false)
+	sent := time.Now()
+
+	// The wall clock was stepped back by an hour while the probe was in
+	// flight, which only the monotonic clock does not notice.
+	cm := &controlMessage{
+		Time:       sent.Round(0).Add(-time.Hour),
+		TimeSource: TimestampKernel,
+		Mono:       sent.Add(time.Millisecond),
+	}
+
+	_, source, rtt := ts.RoundTrip(0, sent, cm)
+	if rtt != time.Millisecond {
+		t.Errorf("unexpected rtt: got %s, want %s", rtt, time.Millisecond)
+	}
+	if source != TimestampUser {
+		t.Errorf("unexpected source: got %s, want %s", source, TimestampUser)
+	}
+	if err := checkRTT(-rtt, time.Second); err != ErrImplausibleRTT {
+		t.Errorf("unexpected error: got %v, want %v", err, ErrImplausibleRTT)
+	}
+}
+
+func TestRoundTripTimestampSources(t *testing.T) {
+	sent := time.Now()
+	wall := sent.Round(0)
+
+	// The clock of the network interface runs on TAI, 37 seconds ahead
+	// of the system clock.
+	phc := wall.Add(37 * time.Second)
+
+	tests := []struct {
+		name   string
+		tx     txTimestamp
+		hw     bool // Whether the reply has a hardware timestamp
+		source TimestampSource
+		rtt    time.Duration
+	}{
+		{"hardware", txTimestamp{wall.Add(100 * time.Microsecond), phc.Add(200 * time.Microsecond)}, true, TimestampHardware, 500 * time.Microsecond},
+		{"software", txTimestamp{wall.Add(100 * time.Microsecond), time.Time{}}, false, TimestampKernel, 800 * time.Microsecond},
+		{"hardware tx, software rx", txTimestamp{wall.Add(100 * time.Microsecond), phc.Add(200 * time.Microsecond)}, false, TimestampKernel, 800 * time.Microsecond},
+		{"hardware tx only, software rx", txTimestamp{time.Time{}, phc.Add(200 * time.Microsecond)}, false, TimestampUser, 900 * time.Microsecond},
+		{"software tx, hardware rx", txTimestamp{wall.Add(100 * time.Microsecond), time.Time{}}, true, TimestampKernel, 800 * time.Microsecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTimestamper(newFakePacketConn(0, nil), false)
+			ts.tx, ts.next = true, 1
+			ts.pending[0] = tt.tx
+
+			cm := &controlMessage{
+				Time:       wall.Add(900 * time.Microsecond),
+				TimeSource: TimestampKernel,
+				Mono:       sent.Add(time.Millisecond),
+			}
+			if tt.hw {
+				cm.HWTime = phc.Add(700 * time.Microsecond)
+			}
+
+			got, source, rtt := ts.RoundTrip(0, sent, cm)
+			if source != tt.source {
+				t.Errorf("unexpected source: got %s, want %s", source, tt.source)
+			}
+			if rtt != tt.rtt {
+				t.Errorf("unexpected rtt: got %s, want %s", rtt, tt.rtt)
+			}
+			if want := cm.Time.Add(-rtt); !got.Equal(want) {
+				t.Errorf("unexpected send time: got %s, want %s", got, want)
+			}
+		})
+	}
+}
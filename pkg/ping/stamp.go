@@ -0,0 +1,388 @@
+package ping
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ericyan/pingd/internal/timestamp"
+)
+
+// STAMPPort is the well-known port of STAMP session-reflectors.
+const STAMPPort = 862
+
+// stampPacketLen is the length of unauthenticated STAMP test packets,
+// excluding padding.
+const stampPacketLen = 44
+
+// stampErrorEstimate returns the error estimate of our timestamps, as
+// defined in RFC 4656 section 4.1.2. The S bit is set if the system
+// clock is synchronized, and the error is the one estimated by the
+// kernel, or about a millisecond if unknown.
+func stampErrorEstimate() uint16 {
+	synced, esterror := clockStatus()
+	if esterror <= 0 {
+		esterror = time.Millisecond
+	}
+
+	// The error is Multiplier*2^(Scale-32) seconds, with an 8-bit
+	// Multiplier and a 6-bit Scale.
+	e := esterror.Seconds() * (1 << 32)
+	scale := uint16(0)
+	for e > 255 && scale < 63 {
+		e /= 2
+		scale++
+	}
+	multiplier := uint16(math.Ceil(e))
+	if multiplier < 1 {
+		multiplier = 1
+	} else if multiplier > 255 {
+		multiplier = 255
+	}
+
+	v := scale<<8 | multiplier
+	if synced {
+		v |= 1 << 15
+	}
+	return v
+}
+
+// stampSynchronized reports whether the S bit is set in the error
+// estimate e.
+func stampSynchronized(e uint16) bool {
+	return e&(1<<15) != 0
+}
+
+// A stampReply is a reflected STAMP test packet.
+type stampReply struct {
+	sent     []byte // Timestamp of the session-sender
+	received timestamp.Timestamp
+	reflect  timestamp.Timestamp
+	synced   bool // Whether the clock of the reflector is synchronized
+	size     int
+	from     net.Addr
+	cm       *controlMessage
+}
+
+// parseSTAMPReply parses a reflected unauthenticated STAMP test packet
+// and returns the sequence number of the session-sender along with it.
+func parseSTAMPReply(b []byte) (uint32, *stampReply, error) {
+	if len(b) < stampPacketLen {
+		return 0, nil, errors.New("stamp packet too short")
+	}
+
+	r := &stampReply{
+		sent: append([]byte(nil), b[28:36]...),
+		size: len(b),
+	}
+	r.reflect.UnmarshalNTP(b[4:12])
+	r.received.UnmarshalNTP(b[16:24])
+	r.synced = stampSynchronized(binary.BigEndian.Uint16(b[12:14]))
+
+	return binary.BigEndian.Uint32(b[24:28]), r, nil
+}
+
+type stampPinger struct {
+	seq     uint32
+	conn4   *net.UDPConn
+	conn6   *net.UDPConn
+	ts4     *timestamper
+	ts6     *timestamper
+	recv    *inflightSet
+	stop    chan bool
+	once    *sync.Once
+	timeout time.Duration
+	size    int
+}
+
+// NewSTAMP returns a Pinger that acts as a STAMP session-sender as
+// defined in RFC 8762, sending unauthenticated test packets over UDP to
+// session-reflectors such as the one returned by NewReflector. This is
+// also compatible with TWAMP-Light reflectors. Destinations are usually
+// on STAMPPort.
+//
+// The time the packet spent in the reflector, as reported by it, is
+// subtracted from the RTT. The timestamps of the reflector are reported
+// in the result, from which one-way delays can be derived if both clocks
+// are synchronized. Packets are padded to the payload size, but never
+// shorter than 44 bytes.
+func NewSTAMP(opts ...Option) (Pinger, error) {
+	cfg := newConfig(opts)
+
+	conn4, err := listenSTAMP(false, cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn6, err := listenSTAMP(true, cfg)
+	if err != nil {
+		log.Printf("STAMP over IPv6 unavailable: %s", err)
+		conn6 = nil
+	}
+
+	size := cfg.payloadSize
+	if size < stampPacketLen {
+		size = stampPacketLen
+	}
+
+	p := &stampPinger{
+		conn4:   conn4,
+		conn6:   conn6,
+		recv:    newInflightSet(),
+		stop:    make(chan bool),
+		once:    new(sync.Once),
+		timeout: cfg.timeout,
+		size:    size,
+	}
+
+	p.ts4 = newTimestamper(conn4, cfg.hwTimestamp)
+	go p.listen(p.conn4, newPacketReader(p.conn4, false))
+	if p.conn6 != nil {
+		p.ts6 = newTimestamper(conn6, cfg.hwTimestamp)
+		go p.listen(p.conn6, newPacketReader(p.conn6, true))
+	}
+
+	return p, nil
+}
+
+// listenSTAMP opens a UDP endpoint on an ephemeral port and applies the
+// options in cfg to it.
+func listenSTAMP(v6 bool, cfg *config) (*net.UDPConn, error) {
+	network := "udp4"
+	if v6 {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: sourceAddr(v6, cfg)})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setSockopts(conn, v6, cfg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (p *stampPinger) listen(conn *net.UDPConn, read packetReader) {
+	readPackets(conn, read, p.timeout, p.stop, func(b []byte, cm *controlMessage, from net.Addr) {
+		seq, reply, err := parseSTAMPReply(b)
+		if err != nil {
+			return
+		}
+		reply.from, reply.cm = from, cm
+		p.recv.deliver(seq, reply)
+	})
+}
+
+func (p *stampPinger) Ping(dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(context.Background(), dst))
+}
+
+func (p *stampPinger) PingContext(ctx context.Context, dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(ctx, dst))
+}
+
+func (p *stampPinger) Probe(ctx context.Context, dst net.Addr) (*Result, error) {
+	dstAddr, ok := dst.(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("dst must be a *net.UDPAddr")
+	}
+
+	select {
+	case <-p.stop:
+		return nil, ErrClosed
+	default:
+	}
+
+	ts := p.ts4
+	if dstAddr.IP.To4() == nil {
+		if p.conn6 == nil {
+			return nil, errors.New("ipv6 unavailable")
+		}
+		ts = p.ts6
+	}
+
+	seq := atomic.AddUint32(&p.seq, 1) - 1
+
+	e := new(inflight)
+	if err := p.recv.add(seq, e); err != nil {
+		return nil, err
+	}
+	defer p.recv.remove(seq)
+
+	// Session-sender test packet, see RFC 8762 section 4.2.1.
+	req := make([]byte, p.size)
+	binary.BigEndian.PutUint32(req[0:4], seq)
+	copy(req[4:12], timestamp.Now().MarshalNTP())
+	estimate := stampErrorEstimate()
+	binary.BigEndian.PutUint16(req[12:14], estimate)
+
+	e.sent = time.Now()
+	id, err := ts.WriteTo(req, dstAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer ts.Sent(id)
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case v := <-e.ch:
+			reply := v.(*stampReply)
+			// A reply carrying another timestamp belongs to an
+			// earlier probe which used the same sequence number.
+			if !bytes.Equal(reply.sent, req[4:12]) {
+				p.recv.markDup(e)
+				continue
+			}
+
+			result := &Result{
+				Seq:            int(seq),
+				Addr:           reply.from,
+				Local:          reply.cm.Dst,
+				TTL:            reply.cm.TTL,
+				Size:           reply.size,
+				Received:       reply.cm.Time,
+				ReceivedSource: reply.cm.TimeSource,
+				RemoteReceived: reply.received.Time(),
+				RemoteSent:     reply.reflect.Time(),
+				Synchronized:   reply.synced && stampSynchronized(estimate),
+			}
+			result.Sent, result.SentSource, result.RTT = ts.RoundTrip(id, e.sent, reply.cm)
+
+			// Leave out the time spent in the reflector, unless its
+			// clock is clearly off.
+			if d := reply.reflect.Time().Sub(reply.received.Time()); d >= 0 && d < result.RTT {
+				result.RTT -= d
+			}
+
+			result.Duplicate = p.recv.duplicate(e)
+
+			return result, checkRTT(result.RTT, p.timeout)
+		case <-timer.C:
+			return nil, ErrTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-p.stop:
+			return nil, ErrClosed
+		}
+	}
+}
+
+func (p *stampPinger) Close() error {
+	if err := closeOnce(p.once, p.stop); err != nil {
+		return err
+	}
+	if p.conn6 != nil {
+		p.conn6.Close()
+	}
+	return p.conn4.Close()
+}
+
+// A Reflector is a stateless STAMP session-reflector as defined in RFC
+// 8762, which answers the test packets sent by STAMP and TWAMP-Light
+// session-senders.
+type Reflector struct {
+	conn *net.UDPConn
+	ts   *timestamper
+	read packetReader
+	stop chan bool
+	once *sync.Once
+}
+
+// NewReflector returns a Reflector listening on the UDP address addr,
+// such as ":862". The IP level options apply to the reflected packets.
+func NewReflector(addr string, opts ...Option) (*Reflector, error) {
+	cfg := newConfig(opts)
+
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	v6 := conn.LocalAddr().(*net.UDPAddr).IP.To4() == nil
+	if err := setSockopts(conn, v6, cfg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Reflector{
+		conn: conn,
+		ts:   newTimestamper(conn, cfg.hwTimestamp),
+		read: newPacketReader(conn, v6),
+		stop: make(chan bool),
+		once: new(sync.Once),
+	}, nil
+}
+
+// Addr returns the address the reflector is listening on.
+func (r *Reflector) Addr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// Serve answers test packets until the reflector is closed.
+func (r *Reflector) Serve() error {
+	buf := make([]byte, 65536)
+	for {
+		n, cm, from, err := r.read(buf)
+		if err != nil {
+			select {
+			case <-r.stop:
+				return nil
+			default:
+			}
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				continue
+			}
+			return err
+		}
+		if n < stampPacketLen {
+			continue
+		}
+
+		// Session-reflector test packet, see RFC 8762 section 4.3.1.
+		// In stateless mode, the sequence number is copied from the
+		// test packet, and the reply is as long as the test packet.
+		b := buf[:n]
+		reply := make([]byte, n)
+		copy(reply[0:4], b[0:4])
+		binary.BigEndian.PutUint16(reply[12:14], stampErrorEstimate())
+		copy(reply[16:24], timestamp.FromTime(cm.Time).MarshalNTP())
+		copy(reply[24:36], b[0:12])
+		copy(reply[36:38], b[12:14])
+		if cm.TTL >= 0 {
+			reply[40] = byte(cm.TTL)
+		}
+		copy(reply[4:12], timestamp.Now().MarshalNTP())
+
+		id, err := r.ts.WriteTo(reply, from)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		// The transmit timestamp comes too late to be of use.
+		r.ts.Sent(id)
+	}
+}
+
+// Close stops the reflector.
+func (r *Reflector) Close() error {
+	if err := closeOnce(r.once, r.stop); err != nil {
+		return err
+	}
+	return r.conn.Close()
+}
@@ -0,0 +1,46 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSTAMPReflector(t *testing.T) {
+	r, err := NewReflector("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go r.Serve()
+
+	p, err := NewSTAMP(WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	dst := r.Addr().(*net.UDPAddr)
+	for i := 0; i < 3; i++ {
+		result, err := p.Probe(context.Background(), dst)
+		if err != nil {
+			t.Fatalf("probe %d: %s", i, err)
+		}
+		if result.Seq != i {
+			t.Errorf("unexpected seq: got %d, want %d", result.Seq, i)
+		}
+		if result.Size != stampPacketLen+12 {
+			t.Errorf("unexpected size: got %d, want %d", result.Size, stampPacketLen+12)
+		}
+		if result.RTT <= 0 {
+			t.Errorf("unexpected rtt: %s", result.RTT)
+		}
+
+		// Both ends share the same clock.
+		forward, reverse, ok := result.OneWayDelays()
+		if !ok || forward < 0 || reverse < 0 {
+			t.Errorf("unexpected one-way delays: %s, %s", forward, reverse)
+		}
+	}
+}
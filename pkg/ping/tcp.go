@@ -1,10 +1,14 @@
 package ping
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
@@ -12,141 +16,363 @@ import (
 )
 
 type tcpPacket struct {
-	t   time.Time
-	err error
+	t    time.Time
+	size int
+	from net.Addr
+	cm   *controlMessage
+	err  error
 }
 
-type tx struct {
-	t  time.Time
-	ch chan *tcpPacket
+// A tcpFlow identifies an outstanding probe by its 4-tuple and the
+// initial sequence number of the SYN.
+type tcpFlow struct {
+	dstIP   string
+	dstPort uint16
+	srcPort uint16
+	seq     uint32
 }
 
+// An expiredFlow is the flow of a probe which is done, but whose SYN-ACK
+// should still be reset until the given time.
+type expiredFlow struct {
+	src   net.IP
+	until time.Time
+}
+
+// SYN-ACKs to probes which are done are still reset for expiredTTL, and
+// at most maxExpired such probes are remembered.
+const (
+	expiredTTL = time.Minute
+	maxExpired = 1 << 12
+)
+
 type tcpPinger struct {
-	conn    *net.IPConn
-	port    uint16
-	mu      *sync.Mutex
-	recv    map[uint32]*tx
+	conn4   *net.IPConn
+	conn6   *net.IPConn
+	ts4     *timestamper
+	ts6     *timestamper
+	ports   [2]uint16 // Range of source ports to rotate through
+	reset   bool      // Whether to reset connections after SYN-ACK
+	next    uint32
+	rand    *rand.Rand
+	recv    *inflightSet
+	mu      *sync.Mutex             // Guards rand and expired
+	expired map[tcpFlow]expiredFlow // Probes whose SYN-ACKs are still reset
 	stop    chan bool
-	timeout uint
+	once    *sync.Once
+	timeout time.Duration
+	src     net.IP
 }
 
-func NewTCP() (Pinger, error) {
-	addr, err := net.ResolveIPAddr("ip4:tcp", "127.0.0.1")
+// NewTCP returns a Pinger that sends TCP SYN packets over raw IPv4 and
+// IPv6 sockets. The IPv6 endpoint is optional: if it cannot be opened,
+// pinging IPv6 destinations will fail but IPv4 destinations still work.
+//
+// Each probe uses a random initial sequence number, so any number of
+// probes may be outstanding at the same time.
+//
+// Unless disabled with WithReset(false), the pinger answers the SYN-ACK
+// to each probe with a RST, including those arriving up to a minute after
+// the probe timed out, so that no half-open connection is left on the
+// target.
+//
+// The source ports must not overlap the range the kernel picks ephemeral
+// ports from, as the pinger would also see the replies to connections
+// made by other processes.
+func NewTCP(opts ...Option) (Pinger, error) {
+	cfg := newConfig(opts)
+	if first, last, ok := localPortRange(); ok && cfg.srcPorts[0] <= last && cfg.srcPorts[1] >= first {
+		return nil, fmt.Errorf("source ports %d-%d overlap the local port range %d-%d", cfg.srcPorts[0], cfg.srcPorts[1], first, last)
+	}
+
+	conn4, err := listenTCP(false, cfg)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.ListenIP("ip4:tcp", addr)
+	conn6, err := listenTCP(true, cfg)
 	if err != nil {
-		return nil, err
+		log.Printf("TCP over IPv6 unavailable: %s", err)
+		conn6 = nil
 	}
 
 	p := &tcpPinger{
-		conn:    conn,
-		port:    23333,
+		conn4:   conn4,
+		conn6:   conn6,
+		ports:   cfg.srcPorts,
+		reset:   cfg.reset,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		recv:    newInflightSet(),
 		mu:      new(sync.Mutex),
-		recv:    make(map[uint32]*tx),
+		expired: make(map[tcpFlow]expiredFlow),
 		stop:    make(chan bool),
-		timeout: 5000,
-	}
-
-	go func(p *tcpPinger) {
-		buf := make([]byte, 1500)
-		for {
-			select {
-			default:
-				p.conn.SetReadDeadline(time.Now().Add(time.Duration(p.timeout) * time.Millisecond))
-
-				n, _, err := p.conn.ReadFrom(buf)
-				if err != nil {
-					// Ignore read timeout errors
-					if neterr, ok := err.(*net.OpError); ok {
-						if neterr.Timeout() {
-							continue
-						}
-					}
-
-					log.Println(err)
-					continue
-				}
-
-				now := time.Now()
-				packet := gopacket.NewPacket(buf[:n], layers.LayerTypeTCP, gopacket.Default)
-				if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-					tcp := tcpLayer.(*layers.TCP)
-
-					if tcp.DstPort != layers.TCPPort(p.port) {
-						continue
-					}
-
-					if c, ok := p.recv[tcp.Ack-1]; ok {
-						if tcp.SYN && tcp.ACK {
-							c.ch <- &tcpPacket{now, nil}
-						} else {
-							c.ch <- &tcpPacket{now, errors.New("port closed")}
-						}
-					}
-				}
-			case <-p.stop:
-				close(p.stop)
-				return
+		once:    new(sync.Once),
+		timeout: cfg.timeout,
+		src:     cfg.src,
+	}
+
+	p.ts4 = newTimestamper(p.conn4, cfg.hwTimestamp)
+	go p.listen(p.conn4, false, newPacketReader(p.conn4, false))
+	if p.conn6 != nil {
+		p.ts6 = newTimestamper(p.conn6, cfg.hwTimestamp)
+		go p.listen(p.conn6, true, newPacketReader(p.conn6, true))
+	}
+
+	return p, nil
+}
+
+// listenTCP opens a raw TCP endpoint and applies the options in cfg to
+// it.
+func listenTCP(v6 bool, cfg *config) (*net.IPConn, error) {
+	network := "ip4:tcp"
+	if v6 {
+		network = "ip6:tcp"
+	}
+	conn, err := net.ListenIP(network, &net.IPAddr{IP: sourceAddr(v6, cfg)})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setSockopts(conn, v6, cfg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (p *tcpPinger) listen(conn *net.IPConn, v6 bool, read packetReader) {
+	readPackets(conn, read, p.timeout, p.stop, func(b []byte, cm *controlMessage, src net.Addr) {
+		packet := gopacket.NewPacket(b, layers.LayerTypeTCP, gopacket.Default)
+		tcpLayer := packet.Layer(layers.LayerTypeTCP)
+		if tcpLayer == nil {
+			return
+		}
+		tcp := tcpLayer.(*layers.TCP)
+
+		if !tcp.ACK || uint16(tcp.DstPort) < p.ports[0] || uint16(tcp.DstPort) > p.ports[1] {
+			return
+		}
+
+		f := tcpFlow{
+			dstIP:   string(src.(*net.IPAddr).IP.To16()),
+			dstPort: uint16(tcp.SrcPort),
+			srcPort: uint16(tcp.DstPort),
+			seq:     tcp.Ack - 1,
+		}
+
+		reply := &tcpPacket{cm.Time, len(b), src, cm, nil}
+		if !tcp.SYN {
+			reply.err = ErrPortClosed
+		}
+
+		// Only SYN-ACKs to our own probes are reset, which includes
+		// those arriving after their probe gave up, as they leave a
+		// half-open connection behind too.
+		var local net.IP
+		if e := p.recv.deliver(f, reply); e != nil {
+			local = e.src
+		} else {
+			p.mu.Lock()
+			if e, ok := p.expired[f]; ok && time.Now().Before(e.until) {
+				local = e.src
 			}
+			p.mu.Unlock()
 		}
-	}(p)
 
-	return p, nil
+		if tcp.SYN && p.reset && local != nil {
+			rst := &layers.TCP{
+				SrcPort: tcp.DstPort,
+				DstPort: tcp.SrcPort,
+				Seq:     tcp.Ack,
+				RST:     true,
+			}
+			if _, err := p.send(local, src.(*net.IPAddr), rst); err != nil {
+				log.Println(err)
+			}
+		}
+	})
+}
+
+// sourceIP returns the local address the kernel would use to reach dst.
+func sourceIP(dst net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 9})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// send serializes seg and sends it from src to dst. It returns the id
+// of the packet for looking up its transmit timestamp.
+func (p *tcpPinger) send(src net.IP, dst *net.IPAddr, seg *layers.TCP) (uint32, error) {
+	// The pseudo-header used for checksumming depends on the address
+	// family of the destination.
+	var ts *timestamper
+	var pseudo gopacket.NetworkLayer
+	if dst.IP.To4() != nil {
+		ts = p.ts4
+		pseudo = &layers.IPv4{
+			SrcIP:    src,
+			DstIP:    dst.IP,
+			Protocol: layers.IPProtocolTCP,
+		}
+	} else {
+		if p.conn6 == nil {
+			return 0, errors.New("ipv6 unavailable")
+		}
+		ts = p.ts6
+		pseudo = &layers.IPv6{
+			SrcIP:      src,
+			DstIP:      dst.IP,
+			NextHeader: layers.IPProtocolTCP,
+		}
+	}
+	seg.SetNetworkLayerForChecksum(pseudo)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+	if err := gopacket.SerializeLayers(buf, opts, seg); err != nil {
+		return 0, err
+	}
+
+	return ts.WriteTo(buf.Bytes(), dst)
+}
+
+// expire remembers the flow of a probe which is done, so that SYN-ACKs
+// arriving late are still reset. Once maxExpired flows are remembered,
+// new ones are only added as old ones expire. The caller must hold mu.
+func (p *tcpPinger) expire(f tcpFlow, src net.IP) {
+	now := time.Now()
+	if len(p.expired) >= maxExpired {
+		for k, e := range p.expired {
+			if now.After(e.until) {
+				delete(p.expired, k)
+			}
+		}
+	}
+	if len(p.expired) < maxExpired {
+		p.expired[f] = expiredFlow{src, now.Add(expiredTTL)}
+	}
 }
 
 func (p *tcpPinger) Ping(dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(context.Background(), dst))
+}
+
+func (p *tcpPinger) PingContext(ctx context.Context, dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(ctx, dst))
+}
+
+func (p *tcpPinger) Probe(ctx context.Context, dst net.Addr) (*Result, error) {
 	dstAddr, ok := dst.(*net.TCPAddr)
 	if !ok {
-		return 0, errors.New("dst must be a *net.TCPAddr")
+		return nil, errors.New("dst must be a *net.TCPAddr")
+	}
+
+	select {
+	case <-p.stop:
+		return nil, ErrClosed
+	default:
+	}
+	if dstAddr.IP.To4() == nil && p.conn6 == nil {
+		return nil, errors.New("ipv6 unavailable")
+	}
+
+	srcIP := p.src
+	if srcIP == nil || (srcIP.To4() == nil) != (dstAddr.IP.To4() == nil) {
+		var err error
+		if srcIP, err = sourceIP(dstAddr.IP); err != nil {
+			return nil, err
+		}
 	}
 
-	seq := uint32(123456789)
+	n := uint32(p.ports[1]-p.ports[0]) + 1
+	srcPort := p.ports[0] + uint16((atomic.AddUint32(&p.next, 1)-1)%n)
 
 	p.mu.Lock()
-	p.recv[seq] = &tx{time.Now(), make(chan *tcpPacket)}
+	seq := p.rand.Uint32()
+	p.mu.Unlock()
+	f := tcpFlow{
+		dstIP:   string(dstAddr.IP.To16()),
+		dstPort: uint16(dstAddr.Port),
+		srcPort: srcPort,
+		seq:     seq,
+	}
+	e := &inflight{src: srcIP}
+	if err := p.recv.add(f, e); err != nil {
+		return nil, err
+	}
 	defer func() {
-		close(p.recv[seq].ch)
-		delete(p.recv, seq)
+		// The flow is remembered before it is removed, so that there
+		// is no gap in which its SYN-ACK would not be reset.
+		p.mu.Lock()
+		p.expire(f, srcIP)
 		p.mu.Unlock()
+		p.recv.remove(f)
 	}()
 
 	syn := &layers.TCP{
-		SrcPort: layers.TCPPort(p.port),
-		DstPort: layers.TCPPort(dstAddr.Port),
-		Seq:     seq,
+		SrcPort: layers.TCPPort(f.srcPort),
+		DstPort: layers.TCPPort(f.dstPort),
+		Seq:     f.seq,
 		SYN:     true,
 	}
-	syn.SetNetworkLayerForChecksum(&layers.IPv4{
-		SrcIP:    p.conn.LocalAddr().(*net.IPAddr).IP,
-		DstIP:    dstAddr.IP,
-		Protocol: layers.IPProtocolTCP,
-	})
-
-	buf := gopacket.NewSerializeBuffer()
-	opts := gopacket.SerializeOptions{
-		ComputeChecksums: true,
-		FixLengths:       true,
+	ts := p.ts4
+	if dstAddr.IP.To4() == nil {
+		ts = p.ts6
 	}
-	if err := gopacket.SerializeLayers(buf, opts, syn); err != nil {
-		return 0, err
+	e.sent = time.Now()
+	id, err := p.send(srcIP, &net.IPAddr{IP: dstAddr.IP, Zone: dstAddr.Zone}, syn)
+	if err != nil {
+		return nil, err
 	}
+	defer ts.Sent(id)
 
-	if _, err := p.conn.WriteTo(buf.Bytes(), &net.IPAddr{dstAddr.IP, dstAddr.Zone}); err != nil {
-		return 0, err
-	}
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
 
 	select {
-	case reply := <-p.recv[seq].ch:
-		rtt := reply.t.Sub(p.recv[seq].t)
-		return rtt, reply.err
-	case <-time.After(time.Duration(p.timeout) * time.Millisecond):
-		return 0, errors.New("timeout")
+	case v := <-e.ch:
+		reply := v.(*tcpPacket)
+		sent, sentSource, rtt := ts.RoundTrip(id, e.sent, reply.cm)
+		err := reply.err
+		if err == nil {
+			err = checkRTT(rtt, p.timeout)
+		}
+
+		return &Result{
+			Seq:            int(f.seq & 0x7fffffff),
+			Addr:           reply.from,
+			Local:          reply.cm.Dst,
+			TTL:            reply.cm.TTL,
+			Size:           reply.size,
+			Sent:           sent,
+			SentSource:     sentSource,
+			Received:       reply.t,
+			ReceivedSource: reply.cm.TimeSource,
+			RTT:            rtt,
+			Duplicate:      p.recv.duplicate(e),
+		}, err
+	case <-timer.C:
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.stop:
+		return nil, ErrClosed
 	}
 }
 
 func (p *tcpPinger) Close() error {
-	p.stop <- true
-	return p.conn.Close()
+	if err := closeOnce(p.once, p.stop); err != nil {
+		return err
+	}
+	if p.conn6 != nil {
+		p.conn6.Close()
+	}
+	return p.conn4.Close()
 }
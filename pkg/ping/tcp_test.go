@@ -0,0 +1,181 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// newLoopbackTCP returns a TCP pinger, skipping the test if raw sockets
+// are unavailable.
+func newLoopbackTCP(t *testing.T, opts ...Option) *tcpPinger {
+	p, err := NewTCP(append(opts, WithTimeout(time.Second))...)
+	if os.IsPermission(err) {
+		t.Skip("raw sockets unavailable")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*tcpPinger)
+}
+
+func TestTCPProbe(t *testing.T) {
+	p := newLoopbackTCP(t)
+	defer p.Close()
+
+	for network, address := range map[string]string{"tcp4": "127.0.0.1:0", "tcp6": "[::1]:0"} {
+		ln, err := net.Listen(network, address)
+		if network == "tcp6" && (err != nil || p.conn6 == nil) {
+			t.Log("ipv6 unavailable")
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().(*net.TCPAddr)
+
+		result, err := p.Probe(context.Background(), addr)
+		if err != nil {
+			t.Fatalf("%s: %s", network, err)
+		}
+		if result.RTT <= 0 || result.Addr.String() != addr.IP.String() {
+			t.Errorf("%s: unexpected result: %+v", network, result)
+		}
+
+		ln.Close()
+		if _, err := p.Probe(context.Background(), addr); err != ErrPortClosed {
+			t.Errorf("%s: unexpected error: got %v, want %v", network, err, ErrPortClosed)
+		}
+	}
+}
+
+func TestTCPConcurrentProbes(t *testing.T) {
+	p := newLoopbackTCP(t, WithSourcePorts(23400, 23415))
+	defer p.Close()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+
+	var mu sync.Mutex
+	seqs := make(map[int]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := p.Probe(context.Background(), addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			seqs[result.Seq] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(seqs) != 32 {
+		t.Errorf("probes did not get their own replies: %d distinct", len(seqs))
+	}
+}
+
+// rstCounter counts the RSTs sent on the loopback interface.
+type rstCounter struct {
+	conn *net.IPConn
+	mu   sync.Mutex
+	rsts map[[2]layers.TCPPort]int
+}
+
+func newRSTCounter(t *testing.T) *rstCounter {
+	conn, err := net.ListenIP("ip4:tcp", &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &rstCounter{conn: conn, rsts: make(map[[2]layers.TCPPort]int)}
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packet := gopacket.NewPacket(buf[:n], layers.LayerTypeTCP, gopacket.Default)
+			if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok && tcp.RST {
+				c.mu.Lock()
+				c.rsts[[2]layers.TCPPort{tcp.SrcPort, tcp.DstPort}]++
+				c.mu.Unlock()
+			}
+		}
+	}()
+
+	return c
+}
+
+// count returns the number of RSTs sent from port src to port dst, once
+// they had time to arrive.
+func (c *rstCounter) count(src, dst int) int {
+	time.Sleep(200 * time.Millisecond)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rsts[[2]layers.TCPPort{layers.TCPPort(src), layers.TCPPort(dst)}]
+}
+
+func TestTCPReset(t *testing.T) {
+	p := newLoopbackTCP(t, WithSourcePorts(23420, 23420))
+	defer p.Close()
+	rsts := newRSTCounter(t)
+	defer rsts.conn.Close()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	if _, err := p.Probe(context.Background(), ln.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	own := rsts.count(23420, port)
+
+	// A SYN-ACK to the source port which does not answer any probe, as
+	// if another process had used the port.
+	synack := &layers.TCP{
+		SrcPort: layers.TCPPort(port + 1),
+		DstPort: 23420,
+		Seq:     1,
+		Ack:     12345,
+		SYN:     true,
+		ACK:     true,
+		Window:  1024,
+	}
+	synack.SetNetworkLayerForChecksum(&layers.IPv4{
+		SrcIP:    net.IPv4(127, 0, 0, 1),
+		DstIP:    net.IPv4(127, 0, 0, 1),
+		Protocol: layers.IPProtocolTCP,
+	})
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}, synack)
+	if _, err := rsts.conn.WriteTo(buf.Bytes(), &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	foreign := rsts.count(23420, port+1)
+
+	// The kernel resets both SYN-ACKs as no socket uses the port, but
+	// only the first one must be reset by the pinger as well.
+	if own != foreign+1 {
+		t.Errorf("unexpected resets: %d for the probe, %d for another flow", own, foreign)
+	}
+}
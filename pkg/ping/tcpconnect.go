@@ -0,0 +1,111 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type tcpConnectPinger struct {
+	seq     uint64
+	dialer  *net.Dialer
+	reset   bool
+	timeout time.Duration
+	stop    chan bool
+	once    *sync.Once
+}
+
+// NewTCPConnect returns a Pinger that measures the time taken to
+// establish TCP connections with the kernel's connect, so unlike the
+// one returned by NewTCP, it does not need raw sockets.
+//
+// Unless disabled with WithReset(false), connections are closed with
+// SO_LINGER set to 0, so that they are reset rather than left in
+// TIME_WAIT.
+func NewTCPConnect(opts ...Option) (Pinger, error) {
+	cfg := newConfig(opts)
+
+	dialer := &net.Dialer{Control: dialControl(cfg)}
+	if cfg.src != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: cfg.src}
+	}
+
+	return &tcpConnectPinger{
+		dialer:  dialer,
+		reset:   cfg.reset,
+		timeout: cfg.timeout,
+		stop:    make(chan bool),
+		once:    new(sync.Once),
+	}, nil
+}
+
+func (p *tcpConnectPinger) Ping(dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(context.Background(), dst))
+}
+
+func (p *tcpConnectPinger) PingContext(ctx context.Context, dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(ctx, dst))
+}
+
+func (p *tcpConnectPinger) Probe(ctx context.Context, dst net.Addr) (*Result, error) {
+	dstAddr, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("dst must be a *net.TCPAddr")
+	}
+
+	select {
+	case <-p.stop:
+		return nil, ErrClosed
+	default:
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-dialCtx.Done():
+		}
+	}()
+
+	// The source address may be of another address family.
+	dialer := *p.dialer
+	if src, ok := dialer.LocalAddr.(*net.TCPAddr); ok && (src.IP.To4() == nil) != (dstAddr.IP.To4() == nil) {
+		dialer.LocalAddr = nil
+	}
+
+	result := &Result{
+		Seq:  int(atomic.AddUint64(&p.seq, 1) & 0xffff),
+		Addr: dstAddr,
+		TTL:  -1,
+	}
+
+	result.Sent = time.Now()
+	conn, err := dialer.DialContext(dialCtx, "tcp", dstAddr.String())
+	result.Received = time.Now()
+	result.RTT = result.Received.Sub(result.Sent)
+
+	if err != nil {
+		if err = dialError(p.stop, ctx, dialCtx, err); err == ErrPortClosed {
+			return result, err
+		}
+		return nil, err
+	}
+
+	tcpConn := conn.(*net.TCPConn)
+	result.Local = tcpConn.LocalAddr().(*net.TCPAddr).IP
+	if p.reset {
+		tcpConn.SetLinger(0)
+	}
+	tcpConn.Close()
+
+	return result, checkRTT(result.RTT, p.timeout)
+}
+
+func (p *tcpConnectPinger) Close() error {
+	return closeOnce(p.once, p.stop)
+}
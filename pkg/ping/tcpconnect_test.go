@@ -0,0 +1,44 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPConnectProbe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	p, err := NewTCPConnect(WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	result, err := p.Probe(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RTT <= 0 || !result.Local.Equal(addr.IP) {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	ln.Close()
+	if _, err := p.Probe(context.Background(), addr); err != ErrPortClosed {
+		t.Errorf("expected ErrPortClosed, got %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package ping
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A TLSAddr is the address of a TLS endpoint, along with the name of the
+// server to verify its certificate against.
+type TLSAddr struct {
+	net.TCPAddr
+	ServerName string
+}
+
+// ResolveTLSAddr resolves hostport into a TLSAddr, with the host as the
+// server name.
+func ResolveTLSAddr(hostport string) (*TLSAddr, error) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveTCPAddr("tcp", hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TLSAddr{*addr, host}, nil
+}
+
+// Network returns "tls".
+func (a *TLSAddr) Network() string {
+	return "tls"
+}
+
+// A TLSHandshakeError is returned when the TLS handshake fails, such as
+// when the certificate of the server cannot be verified.
+type TLSHandshakeError struct {
+	Err error
+}
+
+func (e *TLSHandshakeError) Error() string {
+	return "tls handshake: " + e.Err.Error()
+}
+
+func (e *TLSHandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// TLSInfo describes the TLS session set up by a probe.
+type TLSInfo struct {
+	Connect     time.Duration // Establishing the TCP connection
+	Handshake   time.Duration // Performing the TLS handshake
+	Version     uint16        // Negotiated TLS version, such as tls.VersionTLS13
+	CipherSuite uint16        // Negotiated cipher suite
+	NotAfter    time.Time     // Expiry of the certificate of the server
+}
+
+type tlsPinger struct {
+	seq     uint64
+	timeout time.Duration
+	dialer  *net.Dialer
+	tls     *tls.Config
+	stop    chan bool
+	once    *sync.Once
+}
+
+// NewTLS returns a Pinger that sets up TLS sessions with servers, which
+// are given as a *TLSAddr. The RTT covers both the TCP connection setup
+// and the TLS handshake, which are also reported separately.
+//
+// Certificates are verified unless configured otherwise with
+// WithTLSConfig, and failed handshakes are reported with a
+// TLSHandshakeError.
+func NewTLS(opts ...Option) (Pinger, error) {
+	cfg := newConfig(opts)
+
+	dialer := &net.Dialer{Control: dialControl(cfg)}
+	if cfg.src != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: cfg.src}
+	}
+
+	return &tlsPinger{
+		timeout: cfg.timeout,
+		dialer:  dialer,
+		tls:     cfg.tls,
+		stop:    make(chan bool),
+		once:    new(sync.Once),
+	}, nil
+}
+
+func (p *tlsPinger) Ping(dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(context.Background(), dst))
+}
+
+func (p *tlsPinger) PingContext(ctx context.Context, dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(ctx, dst))
+}
+
+func (p *tlsPinger) Probe(ctx context.Context, dst net.Addr) (*Result, error) {
+	dstAddr, ok := dst.(*TLSAddr)
+	if !ok {
+		return nil, errors.New("dst must be a *TLSAddr")
+	}
+
+	select {
+	case <-p.stop:
+		return nil, ErrClosed
+	default:
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	// The source address may be of another address family.
+	dialer := *p.dialer
+	if src, ok := dialer.LocalAddr.(*net.TCPAddr); ok && (src.IP.To4() == nil) != (dstAddr.IP.To4() == nil) {
+		dialer.LocalAddr = nil
+	}
+
+	result := &Result{
+		Seq:  int(atomic.AddUint64(&p.seq, 1) & 0xffff),
+		Addr: &dstAddr.TCPAddr,
+		TTL:  -1,
+	}
+
+	result.Sent = time.Now()
+	conn, err := dialer.DialContext(reqCtx, "tcp", dstAddr.TCPAddr.String())
+	if err != nil {
+		return nil, dialError(p.stop, ctx, reqCtx, err)
+	}
+	connected := time.Now()
+	defer conn.Close()
+	result.Local = conn.LocalAddr().(*net.TCPAddr).IP
+
+	// Unblock the handshake once the probe is canceled or the pinger is
+	// closed.
+	deadline, _ := reqCtx.Deadline()
+	conn.SetDeadline(deadline)
+	go func() {
+		select {
+		case <-p.stop:
+		case <-reqCtx.Done():
+		}
+		conn.SetDeadline(time.Unix(1, 0))
+	}()
+
+	var cfg *tls.Config
+	if p.tls != nil {
+		cfg = p.tls.Clone()
+	} else {
+		cfg = new(tls.Config)
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = dstAddr.ServerName
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		// Failures caused by the probe being cut short are not the
+		// fault of the server.
+		err = dialError(p.stop, ctx, reqCtx, err)
+		if err == ErrClosed || err == ErrTimeout || ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, &TLSHandshakeError{err}
+	}
+	result.Received = time.Now()
+	result.RTT = result.Received.Sub(result.Sent)
+
+	state := tlsConn.ConnectionState()
+	result.TLS = &TLSInfo{
+		Connect:     connected.Sub(result.Sent),
+		Handshake:   result.Received.Sub(connected),
+		Version:     state.Version,
+		CipherSuite: state.CipherSuite,
+	}
+	if len(state.PeerCertificates) > 0 {
+		result.TLS.NotAfter = state.PeerCertificates[0].NotAfter
+	}
+
+	return result, checkRTT(result.RTT, p.timeout)
+}
+
+func (p *tlsPinger) Close() error {
+	return closeOnce(p.once, p.stop)
+}
@@ -0,0 +1,53 @@
+package ping
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTLSProbe(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	addr, err := ResolveTLSAddr(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	p, err := NewTLS(WithTimeout(time.Second), WithTLSConfig(&tls.Config{RootCAs: roots}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	result, err := p.Probe(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := result.TLS
+	if info.Connect <= 0 || info.Handshake <= 0 || info.Connect+info.Handshake != result.RTT {
+		t.Errorf("unexpected timings: %+v, rtt %s", info, result.RTT)
+	}
+	if info.Version < tls.VersionTLS12 || info.CipherSuite == 0 {
+		t.Errorf("unexpected session parameters: %+v", info)
+	}
+	if !info.NotAfter.Equal(srv.Certificate().NotAfter) {
+		t.Errorf("unexpected certificate expiry: got %s, want %s", info.NotAfter, srv.Certificate().NotAfter)
+	}
+
+	// The certificate of the test server is not trusted by default.
+	untrusted, _ := NewTLS(WithTimeout(time.Second))
+	defer untrusted.Close()
+	var handshakeErr *TLSHandshakeError
+	if _, err := untrusted.Probe(context.Background(), addr); !errors.As(err, &handshakeErr) {
+		t.Errorf("expected TLSHandshakeError, got %v", err)
+	}
+}
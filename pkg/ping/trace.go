@@ -0,0 +1,217 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// A Hop is the outcome of the probe sent with a given TTL during a trace.
+type Hop struct {
+	TTL    int     // TTL or hop limit the probe was sent with
+	Result *Result // Reply to the probe, nil if there was none
+	Err    error   // Error of the probe, nil if the destination replied
+
+	// Extensions of the ICMP error returned by the hop, if any. See
+	// ICMPError.MPLSLabels and ICMPError.Interfaces.
+	MPLSLabels []icmp.MPLSLabel
+	Interfaces []*icmp.InterfaceInfo
+}
+
+// Addr returns the address of the node that answered the probe, or nil
+// if none did.
+func (h *Hop) Addr() net.Addr {
+	if h.Result == nil {
+		return nil
+	}
+	return h.Result.Addr
+}
+
+// A Tracer discovers the path to destinations hop by hop, by sending ICMP
+// echo requests with increasing TTLs and collecting the time exceeded
+// errors returned by the routers along the way.
+//
+// Probes are sent in flows, like Paris traceroute does, so that routers
+// balancing load across equal-cost paths forward all probes of a trace
+// along the same path.
+//
+// Only ICMP probes are supported. UDP and TCP ones would have to be
+// matched with the errors they trigger by the ports embedded in them,
+// whereas the UDP and TCP pingers rely on the kernel or on replies from
+// the destination to do so, and they would only follow the paths taken
+// by traffic to the probed port.
+type Tracer struct {
+	pinger   *icmpPinger
+	maxHops  int
+	maxFlows int
+}
+
+// NewTracer returns a Tracer. It always uses raw sockets, as ICMP errors
+// are not delivered to datagram-oriented ones. The TTL set with WithTTL
+// is ignored in favor of the per-probe ones.
+func NewTracer(opts ...Option) (*Tracer, error) {
+	cfg := newConfig(opts)
+
+	opts = append(opts, WithSocketType(SocketRaw))
+	if cfg.payloadSize < flowOffset-6 {
+		// Make room for the bytes set by setFlow.
+		opts = append(opts, WithPayloadSize(flowOffset-6))
+	}
+	p, err := NewICMP(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tracer{p.(*icmpPinger), cfg.maxHops, cfg.maxFlows}, nil
+}
+
+// traceGap is the delay between the probes of consecutive hops, which
+// keeps routers rate limiting ICMP errors from dropping some of them.
+const traceGap = 50 * time.Millisecond
+
+// Trace traces the path to dst taken by the first flow.
+func (t *Tracer) Trace(ctx context.Context, dst net.Addr) ([]*Hop, error) {
+	return t.TraceFlow(ctx, dst, 0)
+}
+
+// TraceFlow probes the hops to dst with the probes of the given flow, in
+// order and without waiting for the replies to earlier probes, and
+// returns them up to the destination. If the destination is not reached,
+// the hops are returned up to the last one which answered, or the
+// maximum number of hops if none did.
+//
+// The error is only non-nil if the trace could not be completed, in
+// which case the errors of the individual hops should be ignored.
+func (t *Tracer) TraceFlow(ctx context.Context, dst net.Addr, flow int) ([]*Hop, error) {
+	if _, ok := dst.(*net.IPAddr); !ok {
+		return nil, errors.New("dst must be a *net.IPAddr")
+	}
+
+	// Closed once a probe has reached the end of the path, so that no
+	// more probes are sent.
+	end := make(chan bool)
+	var once sync.Once
+
+	var hops []*Hop
+	var wg sync.WaitGroup
+send:
+	for ttl := 1; ttl <= t.maxHops; ttl++ {
+		if ttl > 1 {
+			select {
+			case <-time.After(traceGap):
+			case <-end:
+				break send
+			case <-ctx.Done():
+				break send
+			}
+		}
+
+		hop := &Hop{TTL: ttl}
+		hops = append(hops, hop)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hop.Result, hop.Err = t.pinger.probe(ctx, dst, probeOptions{ttl: hop.TTL, flow: flow})
+			if icmpErr, ok := hop.Err.(*ICMPError); ok {
+				hop.MPLSLabels, hop.Interfaces = icmpErr.MPLSLabels(), icmpErr.Interfaces()
+			}
+			if hop.Err == nil || errors.Is(hop.Err, ErrImplausibleRTT) || errors.Is(hop.Err, ErrDestinationUnreachable) {
+				once.Do(func() { close(end) })
+			}
+		}()
+	}
+	wg.Wait()
+
+	last := 0
+	for i, hop := range hops {
+		switch {
+		case hop.Err == ErrClosed:
+			return nil, ErrClosed
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case hop.Err == nil || errors.Is(hop.Err, ErrImplausibleRTT):
+			// The destination replied.
+			return hops[:i+1], nil
+		case errors.Is(hop.Err, ErrDestinationUnreachable):
+			// Probes with higher TTLs would not get any further.
+			return hops[:i+1], nil
+		case hop.Result != nil:
+			last = i + 1
+		}
+	}
+	if last == 0 {
+		return hops, nil
+	}
+
+	return hops[:last], nil
+}
+
+// A Path is a route to a destination, as traced by a flow.
+type Path struct {
+	Flow int    // Flow of the probes which took the path
+	Hops []*Hop // Hops of the path, as returned by TraceFlow
+}
+
+// mdaStop holds the stopping points of the Multipath Detection Algorithm
+// at 95% confidence: having found k distinct paths, mdaStop[k-1] flows
+// are traced before concluding that there are no more.
+var mdaStop = []int{6, 11, 16, 21, 27, 33, 38, 44, 51, 57, 63, 70, 76, 83, 90, 96}
+
+// Paths enumerates the distinct paths to dst, which are taken by flows
+// balanced across equal-cost paths, by tracing one flow after another.
+// It is a simplified form of the Multipath Detection Algorithm, which
+// compares whole paths rather than the next hops of each router, and
+// gives up after the number of flows set with WithMaxFlows.
+//
+// Paths are returned in the order they were found, along with the first
+// flow which took them, so the same flows are returned as long as the
+// load balancing does not change. Two traces are considered to take the
+// same path unless different nodes answered at the same hop.
+func (t *Tracer) Paths(ctx context.Context, dst net.Addr) ([]*Path, error) {
+	var paths []*Path
+	for flow := 0; flow < t.maxFlows; flow++ {
+		if k := len(paths); k > 0 && (k > len(mdaStop) || flow >= mdaStop[k-1]) {
+			break
+		}
+
+		hops, err := t.TraceFlow(ctx, dst, flow)
+		if err != nil {
+			return nil, err
+		}
+
+		known := false
+		for _, path := range paths {
+			if samePath(path.Hops, hops) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			paths = append(paths, &Path{flow, hops})
+		}
+	}
+
+	return paths, nil
+}
+
+// samePath reports whether the traces a and b are consistent with taking
+// the same path, i.e. no hop was answered by different nodes.
+func samePath(a, b []*Hop) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Result != nil && b[i].Result != nil && a[i].Addr().String() != b[i].Addr().String() {
+			return false
+		}
+	}
+	return true
+}
+
+// Close closes the sockets of the Tracer. Traces in progress return
+// ErrClosed.
+func (t *Tracer) Close() error {
+	return t.pinger.Close()
+}
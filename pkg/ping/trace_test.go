@@ -0,0 +1,29 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTraceLoopback(t *testing.T) {
+	tracer, err := NewTracer(WithTimeout(time.Second))
+	if os.IsPermission(err) {
+		t.Skip("raw sockets unavailable")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracer.Close()
+
+	dst := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	hops, err := tracer.Trace(context.Background(), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hops) != 1 || hops[0].Err != nil || hops[0].Addr().String() != dst.String() {
+		t.Errorf("unexpected hops: %+v", hops)
+	}
+}
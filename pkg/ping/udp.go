@@ -0,0 +1,237 @@
+package ping
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ericyan/pingd/internal/timestamp"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+type udpPinger struct {
+	seq     uint64
+	cfg     *config
+	stop    chan bool
+	once    *sync.Once
+	payload []byte
+}
+
+// NewUDP returns a Pinger that sends UDP datagrams. Each probe is sent
+// from a new socket, so no privileges are required and consecutive
+// probes use different source ports.
+//
+// By default, the destination port is expected to be closed, typically
+// a high port such as 33434, and the RTT is measured to the ICMP port
+// unreachable error sent in response. With WithEcho(true), a UDP reply
+// from an echo service is expected instead, and port unreachable errors
+// are reported as failures.
+func NewUDP(opts ...Option) (Pinger, error) {
+	cfg := newConfig(opts)
+
+	return &udpPinger{
+		cfg:     cfg,
+		stop:    make(chan bool),
+		once:    new(sync.Once),
+		payload: newPayload(cfg),
+	}, nil
+}
+
+// dialUDP opens a UDP endpoint connected to dst and applies the options
+// in cfg to it.
+func dialUDP(dst *net.UDPAddr, cfg *config) (*net.UDPConn, error) {
+	v6 := dst.IP.To4() == nil
+	network := "udp4"
+	if v6 {
+		network = "udp6"
+	}
+	conn, err := net.DialUDP(network, &net.UDPAddr{IP: sourceAddr(v6, cfg)}, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setSockopts(conn, v6, cfg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Without extended reporting, only port unreachable errors can be
+	// told apart, and only by the error returned from reads.
+	setRecvErr(conn, v6)
+
+	return conn, nil
+}
+
+// isPortUnreachable reports whether the ICMP type and code denote a port
+// unreachable error.
+func isPortUnreachable(typ icmp.Type, code int) bool {
+	switch typ {
+	case ipv4.ICMPTypeDestinationUnreachable:
+		return code == 3
+	case ipv6.ICMPTypeDestinationUnreachable:
+		return code == 4
+	default:
+		return false
+	}
+}
+
+func (p *udpPinger) Ping(dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(context.Background(), dst))
+}
+
+func (p *udpPinger) PingContext(ctx context.Context, dst net.Addr) (time.Duration, error) {
+	return rtt(p.Probe(ctx, dst))
+}
+
+func (p *udpPinger) Probe(ctx context.Context, dst net.Addr) (*Result, error) {
+	dstAddr, ok := dst.(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("dst must be a *net.UDPAddr")
+	}
+
+	select {
+	case <-p.stop:
+		return nil, ErrClosed
+	default:
+	}
+
+	v6 := dstAddr.IP.To4() == nil
+	conn, err := dialUDP(dstAddr, p.cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// The error queue of the socket carries both the transmit timestamp
+	// of the probe and the ICMP error sent in response, if any.
+	var qerr *sockError
+	ts := newTimestamper(conn, p.cfg.hwTimestamp)
+	ts.handleError = func(e *sockError) {
+		if e.Origin == originICMP || e.Origin == originICMP6 {
+			qerr = e
+		}
+	}
+	read := newPacketReader(conn, v6)
+
+	seq := int(atomic.AddUint64(&p.seq, 1) & 0xffff)
+
+	payload := make([]byte, len(p.payload))
+	copy(payload, p.payload)
+	b, _ := timestamp.Now().MarshalBinary()
+	copy(payload, b)
+
+	conn.SetReadDeadline(time.Now().Add(p.cfg.timeout))
+
+	// Unblock the reads below once the probe is canceled or the pinger
+	// is closed.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-p.stop:
+		case <-done:
+			return
+		}
+		conn.SetReadDeadline(time.Unix(1, 0))
+	}()
+
+	sent := time.Now()
+	id, err := ts.WriteTo(payload, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		Seq:   seq,
+		Local: conn.LocalAddr().(*net.UDPAddr).IP,
+		TTL:   -1,
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		n, cm, from, err := read(buf)
+		if err != nil {
+			now := time.Now()
+
+			select {
+			case <-p.stop:
+				return nil, ErrClosed
+			default:
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				return nil, ErrTimeout
+			}
+
+			// The read failed because of an ICMP error, which is
+			// described in detail on the error queue.
+			qerr = nil
+			ts.Drain()
+
+			icmpErr := &ICMPError{Dst: dstAddr.IP}
+			cm := &controlMessage{TTL: -1, Time: now, TimeSource: TimestampUser, Mono: now}
+			switch {
+			case qerr != nil:
+				icmpErr.Type = ipv4.ICMPType(qerr.Type)
+				if qerr.Origin == originICMP6 {
+					icmpErr.Type = ipv6.ICMPType(qerr.Type)
+				}
+				icmpErr.Code = int(qerr.Code)
+				icmpErr.From = &net.IPAddr{IP: qerr.Offender}
+				if !qerr.Time.IsZero() {
+					cm.Time, cm.TimeSource = qerr.Time, TimestampKernel
+				}
+				cm.HWTime = qerr.HWTime
+			case errors.Is(err, syscall.ECONNREFUSED):
+				icmpErr.Type, icmpErr.Code = ipv4.ICMPTypeDestinationUnreachable, 3
+				if v6 {
+					icmpErr.Type, icmpErr.Code = ipv6.ICMPTypeDestinationUnreachable, 4
+				}
+				icmpErr.From = &net.IPAddr{IP: dstAddr.IP, Zone: dstAddr.Zone}
+			default:
+				return nil, err
+			}
+
+			result.Addr = icmpErr.From
+			result.Received, result.ReceivedSource = cm.Time, cm.TimeSource
+			result.Sent, result.SentSource, result.RTT = ts.RoundTrip(id, sent, cm)
+
+			if p.cfg.echo || !isPortUnreachable(icmpErr.Type, icmpErr.Code) {
+				return result, icmpErr
+			}
+			return result, checkRTT(result.RTT, p.cfg.timeout)
+		}
+
+		// Echo services return the payload unchanged. A reply
+		// carrying another timestamp belongs to an earlier probe
+		// which used the same source port.
+		if n < 8 || !bytes.Equal(buf[:8], payload[:8]) {
+			continue
+		}
+
+		result.Addr = from
+		if cm.Dst != nil {
+			result.Local = cm.Dst
+		}
+		result.TTL = cm.TTL
+		result.Size = n
+		result.Received, result.ReceivedSource = cm.Time, cm.TimeSource
+		result.Sent, result.SentSource, result.RTT = ts.RoundTrip(id, sent, cm)
+
+		return result, checkRTT(result.RTT, p.cfg.timeout)
+	}
+}
+
+func (p *udpPinger) Close() error {
+	return closeOnce(p.once, p.stop)
+}
@@ -0,0 +1,90 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveEcho echoes the datagrams received on conn, each preceded by one
+// with a payload of another probe, as a late reply to it would be.
+func serveEcho(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		stale := make([]byte, n)
+		conn.WriteTo(stale, addr)
+		conn.WriteTo(buf[:n], addr)
+	}
+}
+
+// closedUDPPort returns the address of a UDP port on the loopback
+// interface that nothing listens on.
+func closedUDPPort(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestUDPProbe(t *testing.T) {
+	p, err := NewUDP(WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// The port unreachable error is the expected reply.
+	addr := closedUDPPort(t)
+	result, err := p.Probe(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RTT <= 0 || result.Addr.String() != addr.IP.String() {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+func TestUDPProbeEcho(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveEcho(conn)
+
+	p, err := NewUDP(WithTimeout(time.Second), WithEcho(true), WithPayloadSize(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	result, err := p.Probe(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RTT <= 0 || result.Size != 32 || result.Addr.String() != addr.String() {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	// Without an echo service, the port unreachable error is a failure.
+	addr = closedUDPPort(t)
+	result, err = p.Probe(context.Background(), addr)
+	var icmpErr *ICMPError
+	if !errors.As(err, &icmpErr) || !isPortUnreachable(icmpErr.Type, icmpErr.Code) {
+		t.Fatalf("expected port unreachable, got %v", err)
+	}
+	if result == nil || result.RTT <= 0 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}